@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-api/internal/data"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const auditContextKey = contextKey("audit")
+
+// audit records every request to the route in the audit log as action, with
+// who made it, from where and the status it ended with. The target defaults
+// to the part of action before the dot and the id in the url, handlers name
+// it with auditTarget when it comes from the body and describe the change
+// with auditChange.
+func (app *application) audit(action string) func(http.Handler) http.Handler {
+	targetType, _, _ := strings.Cut(action, ".")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := &data.AuditEntry{
+				Action:     action,
+				TargetType: targetType,
+				TargetID:   chi.URLParam(r, "id"),
+				IPAddress:  app.clientIP(r),
+				RequestID:  middleware.GetReqID(r.Context()),
+			}
+
+			if user := app.authenticatedUser(r); user != nil {
+				auditActorOn(entry, user.ID, user.Email)
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditContextKey, entry)))
+
+			entry.Status = ww.Status()
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+
+			// the action happened even if the client has gone away since
+			if err := app.models.Audit.Record(context.WithoutCancel(r.Context()), *entry); err != nil {
+				app.errorLog.Println(err)
+			}
+		})
+	}
+}
+
+// auditEntry returns the entry audit is building for r, or nil on routes
+// that are not audited
+func auditEntry(r *http.Request) *data.AuditEntry {
+	entry, _ := r.Context().Value(auditContextKey).(*data.AuditEntry)
+	return entry
+}
+
+func auditActorOn(entry *data.AuditEntry, userID int, email string) {
+	if userID != 0 {
+		entry.ActorID = &userID
+	}
+	entry.ActorEmail = email
+}
+
+// auditActor credits the audited request to a user on routes such as login
+// that nobody is logged in to, userID is 0 when only the email is known
+func auditActor(r *http.Request, userID int, email string) {
+	if entry := auditEntry(r); entry != nil {
+		auditActorOn(entry, userID, email)
+	}
+}
+
+// auditTarget names the record the audited request acted on
+func auditTarget(r *http.Request, targetType string, id interface{}) {
+	if entry := auditEntry(r); entry != nil {
+		entry.TargetType = targetType
+		entry.TargetID = fmt.Sprint(id)
+	}
+}
+
+// auditChange summarizes the target before and after the audited request,
+// either may be nil
+func (app *application) auditChange(r *http.Request, before, after envelope) {
+	entry := auditEntry(r)
+	if entry == nil {
+		return
+	}
+
+	summary := func(v envelope) json.RawMessage {
+		if v == nil {
+			return nil
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			app.errorLog.Println(err)
+			return nil
+		}
+		return b
+	}
+
+	entry.Before = summary(before)
+	entry.After = summary(after)
+}
+
+// userSummary is what the audit log keeps of a user
+func userSummary(u *data.User) envelope {
+	return envelope{
+		"email":      u.Email,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"active":     u.Active,
+		"role":       u.Role,
+		"version":    u.Version,
+	}
+}
+
+// bookSummary is what the audit log keeps of a book
+func bookSummary(b *data.Book) envelope {
+	return envelope{
+		"title":            b.Title,
+		"slug":             b.Slug,
+		"author_id":        b.AuthorID,
+		"publication_year": b.PublicationYear,
+		"cover":            b.Cover,
+		"version":          b.Version,
+	}
+}
+
+// authorSummary is what the audit log keeps of an author
+func authorSummary(a *data.Author) envelope {
+	return envelope{"author_name": a.AuthorName, "slug": a.Slug, "photo": a.Photo}
+}
+
+// AuditLog lists one page of the audit log, newest first
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := readAuditFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	entries, total, err := app.models.Audit.List(r.Context(), filter)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	metadata := newPaginationMetadata(filter.Page, filter.PageSize, total)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"entries": entries, "metadata": metadata},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload, paginationHeaders(r, metadata))
+}
+
+// ExportAuditLog streams every entry matching the same filters as AuditLog as
+// JSON lines, oldest first
+func (app *application) ExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := readAuditFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%s.jsonl"`, time.Now().Format("20060102-150405")))
+
+	enc := json.NewEncoder(w)
+	err = app.models.Audit.Export(r.Context(), filter, func(entry *data.AuditEntry) error {
+		return enc.Encode(entry)
+	})
+
+	// the status has gone out with the first line, so a failure part way can
+	// only be logged
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// readAuditFilter reads the parameters AuditLog and ExportAuditLog accept,
+// from and to are RFC 3339 times
+func readAuditFilter(qs url.Values) (data.AuditFilter, error) {
+	var filter data.AuditFilter
+	var err error
+
+	filter.Page, err = readInt(qs, "page", 1)
+	if err != nil {
+		return filter, err
+	}
+	filter.PageSize, err = readInt(qs, "page_size", 50)
+	if err != nil {
+		return filter, err
+	}
+	filter.ActorID, err = readInt(qs, "actor", 0)
+	if err != nil {
+		return filter, err
+	}
+
+	filter.Action = qs.Get("action")
+	filter.TargetType = qs.Get("target_type")
+	filter.TargetID = qs.Get("target_id")
+
+	for key, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := qs.Get(key); value != "" {
+			*t, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", key)
+			}
+		}
+	}
+
+	return filter, filter.Validate()
+}
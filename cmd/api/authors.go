@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-api/internal/data"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mozillazg/go-slugify"
+)
+
+// OneAuthor returns an author's public page, with a page of their books
+func (app *application) OneAuthor(w http.ResponseWriter, r *http.Request) {
+	author, err := app.models.Author.GetOneBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeAuthor(w, r, author)
+}
+
+// AuthorById returns one author with a page of their books
+func (app *application) AuthorById(w http.ResponseWriter, r *http.Request) {
+	authorID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	author, err := app.models.Author.GetOneById(r.Context(), authorID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeAuthor(w, r, author)
+}
+
+// writeAuthor responds with author, the url of their photo if they have one,
+// and the page of their books asked for with ?page= and ?page_size=
+func (app *application) writeAuthor(w http.ResponseWriter, r *http.Request, author *data.Author) {
+	filter := data.BookFilter{AuthorID: author.ID}
+
+	var err error
+	filter.Page, err = readInt(r.URL.Query(), "page", 1)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	filter.PageSize, err = readInt(r.URL.Query(), "page_size", 20)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := filter.Validate(); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	books, total, err := app.models.Book.GetAllFiltered(r.Context(), filter)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.resolveCovers(r.Context(), books...); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	author.PhotoURL, author.Photos, err = app.resolveImages(r.Context(), photoKey, author.Photo, author.Photos)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	metadata := newPaginationMetadata(filter.Page, filter.PageSize, total)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"author": author, "photo": author.PhotoURL, "books": books, "metadata": metadata},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload, paginationHeaders(r, metadata))
+}
+
+// EditAuthor adds an author when no id is given, and updates one otherwise.
+// A photo is cleaned and resized like a book cover, and kept under the
+// author's id so it stays put when they are renamed.
+func (app *application) EditAuthor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID          int    `json:"id"`
+		AuthorName  string `json:"author_name"`
+		Bio         string `json:"bio"`
+		PhotoBase64 string `json:"photo"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	author := data.Author{
+		ID:         requestPayload.ID,
+		AuthorName: strings.TrimSpace(requestPayload.AuthorName),
+		Bio:        requestPayload.Bio,
+	}
+
+	if author.AuthorName == "" || slugify.Slugify(author.AuthorName) == "" {
+		app.errorJSON(w, errors.New("author name is required"))
+		return
+	}
+
+	var previous *data.Author
+	var before envelope
+	if author.ID != 0 {
+		existing, err := app.models.Author.GetOneById(r.Context(), author.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+			return
+		} else if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		previous = existing
+		before = authorSummary(existing)
+	}
+
+	// a new photo is checked before anything is saved
+	var cleaned []byte
+	var ext string
+	var img image.Image
+	if len(requestPayload.PhotoBase64) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(requestPayload.PhotoBase64)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		cleaned, ext, img, err = cleanCover(decoded)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// the photo is stored before the author is saved, so they are never saved
+	// without it. Like a book cover it is named after the author's id, which
+	// is reserved for a new author.
+	var photo *processedCover
+	if img != nil {
+		var err error
+		if previous == nil {
+			author.ID, err = app.models.Author.NextID(r.Context())
+		}
+		if err == nil {
+			photo, err = processCover(author.ID, cleaned, ext, img)
+		}
+		if err == nil {
+			err = app.storeImages(r.Context(), photoKey, photo)
+		}
+		if err != nil {
+			if photo != nil {
+				app.removeImages(r.Context(), photoKey, photo.name, photo.covers)
+			}
+			app.errorJSON(w, fmt.Errorf("storing photo: %w", err), http.StatusInternalServerError)
+			return
+		}
+
+		author.Photo = photo.name
+		author.Photos = photo.covers
+	}
+
+	var err error
+	if previous == nil {
+		author.ID, err = app.models.Author.Insert(r.Context(), author)
+	} else {
+		err = app.models.Author.Update(r.Context(), author)
+	}
+
+	if err != nil && photo != nil {
+		app.removeImages(r.Context(), photoKey, photo.name, photo.covers)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if photo != nil && previous != nil {
+		app.removeImages(r.Context(), photoKey, previous.Photo, previous.Photos)
+	}
+
+	// the store may have numbered the slug to keep it unique
+	saved, err := app.models.Author.GetOneById(r.Context(), author.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "author", saved.ID)
+	app.auditChange(r, before, authorSummary(saved))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Changes Saved",
+		Data:    envelope{"id": saved.ID, "slug": saved.Slug},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// AuthorDelete deletes an author and their photo, authors who still have
+// books are refused with a conflict
+func (app *application) AuthorDelete(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID int `json:"id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	author, err := app.models.Author.GetOneById(r.Context(), requestPayload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "author", author.ID)
+	app.auditChange(r, authorSummary(author), nil)
+
+	err = app.models.Author.DeleteByID(r.Context(), author.ID)
+	if errors.Is(err, data.ErrAuthorHasBooks) {
+		app.errorJSON(w, errors.New("author still has books, including any in the trash, delete or reassign them first"), http.StatusConflict)
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("author not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.removeImages(r.Context(), photoKey, author.Photo, author.Photos)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Author Deleted",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-api/internal/data"
+	"go-api/internal/storage"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// limits on uploaded covers
+const (
+	maxCoverBytes  = 10 << 20
+	maxCoverWidth  = 4000
+	maxCoverHeight = 6000
+)
+
+// coverSizes are the widths every cover is resized to, covers narrower than
+// a size are kept at their own width rather than scaled up
+var coverSizes = []struct {
+	name  string
+	width int
+}{
+	{"thumbnail", 160},
+	{"card", 320},
+	{"detail", 640},
+}
+
+var errNotAnImage = errors.New("image must be a JPEG, PNG, GIF or WebP")
+var errEmptyImage = errors.New("image must be at least 1x1 pixels")
+
+// coverKey is the storage key of the cover file with the given name
+func coverKey(name string) string {
+	return "covers/" + name
+}
+
+// photoKey is the storage key of the author photo file with the given name,
+// photos are named and sized the same way as covers
+func photoKey(name string) string {
+	return "authors/" + name
+}
+
+// coverContentType is the content type of a cover file, from its extension
+func coverContentType(name string) string {
+	switch path.Ext(name) {
+	case ".jpg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// coverBase returns a new file name, without extension, for a cover of the
+// book, or photo of the author, with id, such as "12/3f2a9c1d". Covers are
+// kept by id so they stay put when a book is renamed, and every upload gets
+// its own name so storing it never overwrites a cover that is still in use.
+func coverBase(id int) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s", id, hex.EncodeToString(b)), nil
+}
+
+// keyedByBook reports whether the cover file name is kept under bookID
+func keyedByBook(name string, bookID int) bool {
+	return strings.HasPrefix(name, strconv.Itoa(bookID)+"/")
+}
+
+// cleanCover checks raw is an image of an acceptable size and re-encodes it,
+// which drops EXIF and any other metadata. JPEGs stay JPEGs and every other
+// format becomes a PNG, the returned extension says which.
+func cleanCover(raw []byte) ([]byte, string, image.Image, error) {
+	format := http.DetectContentType(raw)
+	switch format {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil, "", nil, errNotAnImage
+	}
+
+	// check the dimensions before decoding, so a small file claiming to be a
+	// huge image is turned away without allocating its pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", nil, errNotAnImage
+	}
+
+	if config.Width > maxCoverWidth || config.Height > maxCoverHeight {
+		return nil, "", nil, fmt.Errorf("image must be at most %dx%d pixels", maxCoverWidth, maxCoverHeight)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", nil, errNotAnImage
+	}
+
+	// renderCover scales by the width, an image without pixels has none
+	if img.Bounds().Dx() == 0 || img.Bounds().Dy() == 0 {
+		return nil, "", nil, errEmptyImage
+	}
+
+	var buf bytes.Buffer
+
+	if format == "image/jpeg" {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, "", nil, err
+		}
+		return buf.Bytes(), ".jpg", img, nil
+	}
+
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", nil, err
+	}
+	return buf.Bytes(), ".png", img, nil
+}
+
+// processedCover is a cleaned cover and its resized copies, ready to be saved
+type processedCover struct {
+	name   string
+	files  map[string][]byte
+	covers data.CoverSet
+}
+
+// processCover renders every size of a cover cleaned by cleanCover in JPEG
+// and WebP, named for the book or author with id
+func processCover(id int, cleaned []byte, ext string, img image.Image) (*processedCover, error) {
+	base, err := coverBase(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderCover(img, base+ext, cleaned, base)
+}
+
+// renderCover resizes img, the cover saved as name, into every cover size.
+// Files are named after base, such as base-thumbnail.webp.
+func renderCover(img image.Image, name string, original []byte, base string) (*processedCover, error) {
+	p := &processedCover{
+		name:   name,
+		files:  map[string][]byte{},
+		covers: data.CoverSet{},
+	}
+
+	if original != nil {
+		p.files[name] = original
+	}
+
+	bounds := img.Bounds()
+
+	for _, size := range coverSizes {
+		width := size.width
+		if bounds.Dx() < width {
+			width = bounds.Dx()
+		}
+		height := bounds.Dy() * width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+
+		resized := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+
+		var jpg bytes.Buffer
+		if err := jpeg.Encode(&jpg, resized, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+
+		var webp bytes.Buffer
+		if err := nativewebp.Encode(&webp, resized, nil); err != nil {
+			return nil, err
+		}
+
+		jpgName := fmt.Sprintf("%s-%s.jpg", base, size.name)
+		webpName := fmt.Sprintf("%s-%s.webp", base, size.name)
+		p.files[jpgName] = jpg.Bytes()
+		p.files[webpName] = webp.Bytes()
+
+		p.covers[size.name] = data.CoverSize{
+			JPEG: data.CoverImage{Name: jpgName, Width: width, Height: height},
+			WebP: data.CoverImage{Name: webpName, Width: width, Height: height},
+		}
+	}
+
+	return p, nil
+}
+
+// storeCover uploads every file of a cover
+func (app *application) storeCover(ctx context.Context, p *processedCover) error {
+	return app.storeImages(ctx, coverKey, p)
+}
+
+// removeCover deletes the files of a cover that is no longer used
+func (app *application) removeCover(ctx context.Context, name string, covers data.CoverSet) {
+	app.removeImages(ctx, coverKey, name, covers)
+}
+
+// storeImages uploads every file of a processed cover or photo under the
+// keys key gives their names
+func (app *application) storeImages(ctx context.Context, key func(string) string, p *processedCover) error {
+	for name, content := range p.files {
+		if err := app.storage.Put(ctx, key(name), content, coverContentType(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeImages deletes the file name and every file of set, stored under
+// the keys key gives their names
+func (app *application) removeImages(ctx context.Context, key func(string) string, name string, set data.CoverSet) {
+	for _, file := range append([]string{name}, set.Files()...) {
+		if file == "" {
+			continue
+		}
+
+		if err := app.storage.Delete(ctx, key(file)); err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+// resolveImages returns the url of the file name and a copy of set with the
+// url of every file filled in, the set may be shared with the store
+func (app *application) resolveImages(ctx context.Context, key func(string) string, name string, set data.CoverSet) (string, data.CoverSet, error) {
+	var url string
+	if name != "" {
+		var err error
+		if url, err = app.storage.URL(ctx, key(name)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	resolved := make(data.CoverSet, len(set))
+	for size, images := range set {
+		var err error
+		if images.JPEG.URL, err = app.storage.URL(ctx, key(images.JPEG.Name)); err != nil {
+			return "", nil, err
+		}
+		if images.WebP.URL, err = app.storage.URL(ctx, key(images.WebP.Name)); err != nil {
+			return "", nil, err
+		}
+		resolved[size] = images
+	}
+
+	return url, resolved, nil
+}
+
+// resolveCovers fills in the urls of the covers of books, which depend on
+// the storage backend and, for private buckets, expire
+func (app *application) resolveCovers(ctx context.Context, books ...*data.Book) error {
+	for _, book := range books {
+		var err error
+		book.CoverURL, book.Covers, err = app.resolveImages(ctx, coverKey, book.Cover, book.Covers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UploadCover replaces a book's cover with an image sent as the "cover" field
+// of a multipart form. Like EditBook it only saves over the version of the
+// book the editor read, from If-Match or the "version" field.
+func (app *application) UploadCover(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	book, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// leave room for the rest of the form around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxCoverBytes+1<<20)
+
+	file, _, err := r.FormFile("cover")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		app.errorJSON(w, fmt.Errorf("cover must be at most %d MB", maxCoverBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		app.errorJSON(w, errors.New("a cover file is required"))
+		return
+	}
+	defer file.Close()
+
+	formVersion, _ := strconv.Atoi(r.FormValue("version"))
+	version, ifMatch, err := expectedVersion(r, formVersion)
+	if err != nil {
+		app.versionError(w, err)
+		return
+	}
+
+	// a stale version is turned away before the cover is processed, SetCover
+	// checks it again for saves that race this one
+	if version != book.Version {
+		app.bookConflict(w, r, ifMatch, book.ID)
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(file, maxCoverBytes+1))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if len(raw) > maxCoverBytes {
+		app.errorJSON(w, fmt.Errorf("cover must be at most %d MB", maxCoverBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	cleaned, ext, img, err := cleanCover(raw)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	cover, err := processCover(book.ID, cleaned, ext, img)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.storeCover(r.Context(), cover); err != nil {
+		app.removeCover(r.Context(), cover.name, cover.covers)
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.models.Book.SetCover(r.Context(), book.ID, cover.name, cover.covers, version); err != nil {
+		app.removeCover(r.Context(), cover.name, cover.covers)
+		if errors.Is(err, data.ErrEditConflict) {
+			app.bookConflict(w, r, ifMatch, book.ID)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.removeCover(r.Context(), book.Cover, book.Covers)
+
+	app.auditChange(r, envelope{"cover": book.Cover}, envelope{"cover": cover.name})
+
+	saved, err := app.models.Book.GetOneById(r.Context(), book.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.resolveCovers(r.Context(), saved); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Cover Saved",
+		Data:    envelope{"cover": saved.Cover, "cover_url": saved.CoverURL, "covers": saved.Covers, "version": saved.Version},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload, versionHeader(saved.Version))
+}
+
+// backfillCovers renders the sizes of every book cover and author photo
+// saved before they were generated, or of all of them with -all. Covers
+// still named after the book's slug are moved under its id, and photos
+// saved as authors/<slug>.jpg before authors kept them are imported.
+//
+//	go run ./cmd/api covers backfill [-all]
+func (app *application) backfillCovers(args []string) error {
+	if len(args) == 0 || args[0] != "backfill" {
+		return errors.New("usage: covers backfill [-all]")
+	}
+	all := len(args) > 1 && args[1] == "-all"
+
+	ctx := context.Background()
+
+	if err := app.backfillBookCovers(ctx, all); err != nil {
+		return err
+	}
+
+	return app.backfillAuthorPhotos(ctx, all)
+}
+
+// backfillBookCovers is the book half of backfillCovers
+func (app *application) backfillBookCovers(ctx context.Context, all bool) error {
+	books, err := app.models.Book.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	var done, skipped int
+	for _, book := range books {
+		rekey := !keyedByBook(book.Cover, book.ID)
+		if book.Cover == "" || (len(book.Covers) > 0 && !rekey && !all) {
+			skipped++
+			continue
+		}
+
+		raw, err := app.storage.Get(ctx, coverKey(book.Cover))
+		if errors.Is(err, storage.ErrNotFound) {
+			app.infoLog.Printf("%s: cover %s is missing, skipping", book.Slug, book.Cover)
+			skipped++
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// legacy covers were saved as uploaded, clean them like uploads now
+		cleaned, ext, img, err := cleanCover(raw)
+		if err != nil {
+			app.errorLog.Printf("%s: cannot use %s: %v", book.Slug, book.Cover, err)
+			skipped++
+			continue
+		}
+
+		// covers already kept by id were cleaned when uploaded and keep their
+		// names, so storing the sizes again simply replaces the old files
+		var cover *processedCover
+		if rekey {
+			cover, err = processCover(book.ID, cleaned, ext, img)
+		} else {
+			cover, err = renderCover(img, book.Cover, nil, strings.TrimSuffix(book.Cover, path.Ext(book.Cover)))
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := app.storeCover(ctx, cover); err != nil {
+			return err
+		}
+
+		if err := app.models.Book.SetCover(ctx, book.ID, cover.name, cover.covers, 0); err != nil {
+			return err
+		}
+
+		if rekey {
+			app.removeCover(ctx, book.Cover, book.Covers)
+		}
+
+		done++
+	}
+
+	app.infoLog.Printf("generated cover sizes for %d books, skipped %d", done, skipped)
+
+	return nil
+}
+
+// backfillAuthorPhotos is the author half of backfillCovers
+func (app *application) backfillAuthorPhotos(ctx context.Context, all bool) error {
+	authors, err := app.models.Author.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	var done, skipped int
+	for _, author := range authors {
+		// photos used to be kept by slug, with nothing in the author row
+		legacy := author.Photo == ""
+		name := author.Photo
+		if legacy {
+			name = author.Slug + ".jpg"
+		} else if len(author.Photos) > 0 && !all {
+			skipped++
+			continue
+		}
+
+		raw, err := app.storage.Get(ctx, photoKey(name))
+		if errors.Is(err, storage.ErrNotFound) {
+			if !legacy {
+				app.infoLog.Printf("%s: photo %s is missing, skipping", author.Slug, name)
+			}
+			skipped++
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		cleaned, ext, img, err := cleanCover(raw)
+		if err != nil {
+			app.errorLog.Printf("%s: cannot use %s: %v", author.Slug, name, err)
+			skipped++
+			continue
+		}
+
+		var photo *processedCover
+		if legacy {
+			photo, err = processCover(author.ID, cleaned, ext, img)
+		} else {
+			photo, err = renderCover(img, name, nil, strings.TrimSuffix(name, path.Ext(name)))
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := app.storeImages(ctx, photoKey, photo); err != nil {
+			return err
+		}
+
+		if err := app.models.Author.SetPhoto(ctx, author.ID, photo.name, photo.covers); err != nil {
+			return err
+		}
+
+		if legacy {
+			app.removeImages(ctx, photoKey, name, nil)
+		}
+
+		done++
+	}
+
+	app.infoLog.Printf("generated photo sizes for %d authors, skipped %d", done, skipped)
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestCleanCover(t *testing.T) {
+	encode := func(t *testing.T, format string, r image.Rectangle) []byte {
+		t.Helper()
+
+		var buf bytes.Buffer
+		var err error
+		switch format {
+		case "png":
+			err = png.Encode(&buf, image.NewRGBA(r))
+		case "gif":
+			err = gif.Encode(&buf, image.NewPaletted(r, palette.Plan9), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	jpg := testJPEG(t, 300, 400)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		ext     string
+		wantErr string
+	}{
+		{"jpeg", jpg, ".jpg", ""},
+		{"png", encode(t, "png", image.Rect(0, 0, 300, 400)), ".png", ""},
+		{"gif becomes png", encode(t, "gif", image.Rect(0, 0, 300, 400)), ".png", ""},
+		{"widest", encode(t, "png", image.Rect(0, 0, maxCoverWidth, 1)), ".png", ""},
+		{"highest", encode(t, "png", image.Rect(0, 0, 1, maxCoverHeight)), ".png", ""},
+		{"text", []byte("not an image"), "", errNotAnImage.Error()},
+		{"html", []byte("<html><body><img></body></html>"), "", errNotAnImage.Error()},
+		{"empty", nil, "", errNotAnImage.Error()},
+		{"truncated jpeg", jpg[:len(jpg)/2], "", errNotAnImage.Error()},
+		{"jpeg header only", jpg[:20], "", errNotAnImage.Error()},
+		{"too wide", encode(t, "png", image.Rect(0, 0, maxCoverWidth+1, 10)), "", "image must be at most 4000x6000 pixels"},
+		{"too high", encode(t, "png", image.Rect(0, 0, 10, maxCoverHeight+1)), "", "image must be at most 4000x6000 pixels"},
+		{"zero width", encode(t, "gif", image.Rect(0, 0, 0, 10)), "", errEmptyImage.Error()},
+		{"zero height", encode(t, "gif", image.Rect(0, 0, 10, 0)), "", errEmptyImage.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaned, ext, img, err := cleanCover(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ext != tt.ext {
+				t.Fatalf("ext = %s, want %s", ext, tt.ext)
+			}
+
+			decoded, _, err := image.Decode(bytes.NewReader(cleaned))
+			if err != nil {
+				t.Fatalf("cleaned image does not decode: %v", err)
+			}
+			if decoded.Bounds().Size() != img.Bounds().Size() {
+				t.Fatalf("cleaned image is %v, want %v", decoded.Bounds().Size(), img.Bounds().Size())
+			}
+		})
+	}
+}
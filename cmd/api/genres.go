@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"go-api/internal/data"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mozillazg/go-slugify"
+)
+
+// AllGenres returns every genre with how many books it has
+func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Genre.All(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"genres": genres},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// GenreBooks returns one page of the books in a genre, it takes the same
+// parameters as AllBooks
+func (app *application) GenreBooks(w http.ResponseWriter, r *http.Request) {
+	genre, err := app.models.Genre.GetOneBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	filter, err := readBookFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	filter.GenreIDs = []int{genre.ID}
+
+	app.writeBooks(w, r, filter)
+}
+
+// EditGenre adds a genre when no id is given, and renames one otherwise
+func (app *application) EditGenre(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID        int    `json:"id"`
+		GenreName string `json:"genre_name"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	genre := data.Genre{
+		ID:        requestPayload.ID,
+		GenreName: strings.TrimSpace(requestPayload.GenreName),
+	}
+
+	if genre.GenreName == "" || slugify.Slugify(genre.GenreName) == "" {
+		app.errorJSON(w, errors.New("genre name is required"))
+		return
+	}
+
+	var err error
+	var before envelope
+	if genre.ID == 0 {
+		genre.ID, err = app.models.Genre.Insert(r.Context(), genre)
+	} else {
+		if existing, err := app.models.Genre.GetOneById(r.Context(), genre.ID); err == nil {
+			before = envelope{"genre_name": existing.GenreName}
+		}
+		err = app.models.Genre.Update(r.Context(), genre)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "genre", genre.ID)
+	app.auditChange(r, before, envelope{"genre_name": genre.GenreName})
+
+	// the store numbers the slug when another genre has it
+	saved, err := app.models.Genre.GetOneById(r.Context(), genre.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Changes Saved",
+		Data:    envelope{"id": saved.ID, "slug": saved.Slug},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GenreDelete deletes a genre, its books are kept and just lose the genre
+func (app *application) GenreDelete(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID int `json:"id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "genre", requestPayload.ID)
+	if genre, err := app.models.Genre.GetOneById(r.Context(), requestPayload.ID); err == nil {
+		app.auditChange(r, envelope{"genre_name": genre.GenreName}, nil)
+	}
+
+	err := app.models.Genre.DeleteByID(r.Context(), requestPayload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Genre Deleted",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// GenreMerge moves every book of one genre into another and deletes the
+// first, for cleaning up duplicates such as "Sci-Fi" and "Science Fiction"
+func (app *application) GenreMerge(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		FromID int `json:"from_id"`
+		IntoID int `json:"into_id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "genre", requestPayload.FromID)
+	app.auditChange(r, nil, envelope{"merged_into": requestPayload.IntoID})
+
+	err := app.models.Genre.Merge(r.Context(), requestPayload.FromID, requestPayload.IntoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Genres Merged",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"go-api/internal/data"
+	"go-api/internal/mailer"
+	"image"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/mozillazg/go-slugify"
 )
 
 var staticPath = "./static/"
@@ -39,42 +42,107 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 		payload.Error = true
 		payload.Message = "invalid json data"
 		_ = app.writeJSON(w, http.StatusBadRequest, payload)
+		return
 	}
 
-	app.infoLog.Println(creds.Username, creds.Password)
-	user, err := app.models.User.GetUserByEmail(creds.Username)
+	ip := app.clientIP(r)
+	auditActor(r, 0, creds.Username)
 
+	lockedUntil, locked, err := app.loginLockedUntil(r.Context(), data.EmailAttemptKey(creds.Username), data.IPAttemptKey(ip))
 	if err != nil {
-		println("failed here")
-		app.errorJSON(w, errors.New("invalid username"))
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if locked {
+		retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		app.errorJSON(w, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
 		return
 	}
 
+	// unknown emails and wrong passwords get the same answer in the same
+	// time, so the response does not tell which accounts exist
+	invalidCredentials := errors.New("invalid email or password")
+
+	user, err := app.models.User.GetUserByEmail(r.Context(), creds.Username)
+	if err != nil {
+		data.DummyPasswordMatch(creds.Password)
+		if err := app.recordLoginFailure(r.Context(), creds.Username, ip); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.errorJSON(w, invalidCredentials)
+		return
+	}
+
+	auditTarget(r, "user", user.ID)
+
 	validPassword, err := user.UserPasswordMatch(creds.Password)
 	if err != nil || !validPassword {
-		app.errorJSON(w, errors.New("invalid password"))
+		if err := app.recordLoginFailure(r.Context(), creds.Username, ip); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.errorJSON(w, invalidCredentials)
 		return
 	}
 
+	auditActor(r, user.ID, user.Email)
+
 	if user.Active == 0 {
 		app.errorJSON(w, errors.New("inactive User"))
 		return
 	}
 
-	token, err := app.models.Token.GenerateToken(user.ID, 24*time.Hour)
-	if err != nil {
-		app.errorJSON(w, err)
+	// with two-factor authentication on, the password only earns a ticket
+	// for the second step, failed attempts keep counting until it is done
+	totp, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	err = app.models.Token.InsertToken(*token, *user)
+	if err == nil && totp.Enabled {
+		ticket, err := app.models.MFA.GenerateTicket(user.ID, mfaTicketTTL)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		err = app.models.MFA.InsertTicket(r.Context(), *ticket)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		payload = jsonResponse{
+			Error:   false,
+			Message: "two-factor authentication required",
+			Data:    envelope{"mfa_required": true, "mfa_ticket": ticket.Ticket},
+		}
+
+		_ = app.writeJSON(w, http.StatusOK, payload)
+		return
+	}
+
+	if err := app.models.LoginAttempt.Reset(r.Context(), data.EmailAttemptKey(creds.Username)); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin issues a new pair of tokens for user and writes them out
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	token, refreshToken, err := app.issueTokens(r, user)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	payload = jsonResponse{
+	payload := jsonResponse{
 		Error:   false,
 		Message: "logged in",
-		Data:    envelope{"token": token, "user": user},
+		Data:    envelope{"token": token, "refresh_token": refreshToken, "user": user, "permissions": user.Permissions()},
 	}
 
 	err = app.writeJSON(w, http.StatusOK, payload)
@@ -83,9 +151,117 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// issueTokens starts a new login for user with a short-lived access token and
+// the first refresh token of a new family, and saves both
+func (app *application) issueTokens(r *http.Request, user *data.User) (*data.Token, *data.RefreshToken, error) {
+	refreshToken, err := app.models.RefreshToken.GenerateRefreshToken(user.ID, "", app.config.refreshTokenTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := app.models.Token.GenerateToken(user.ID, app.config.accessTokenTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token.UserAgent = r.UserAgent()
+	token.IPAddress = app.clientIP(r)
+	token.FamilyID = refreshToken.FamilyID
+
+	err = app.models.Token.InsertToken(r.Context(), *token, *user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = app.models.RefreshToken.Insert(r.Context(), *refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, nil
+}
+
+func (app *application) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, errors.New("invalid json"))
+		return
+	}
+
+	used, err := app.models.RefreshToken.GetByToken(r.Context(), requestPayload.RefreshToken)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	auditActor(r, used.UserID, "")
+	auditTarget(r, "user", used.UserID)
+
+	// a refresh token is only good once, seeing it again means it leaked
+	if used.UsedAt != nil {
+		if err := app.models.RefreshToken.RevokeFamily(r.Context(), used.FamilyID); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.errorJSON(w, errors.New("refresh token already used, please log in again"), http.StatusUnauthorized)
+		return
+	}
+
+	if used.Expiry.Before(time.Now()) {
+		app.errorJSON(w, errors.New("refresh token expired, please log in again"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.models.User.GetUserById(r.Context(), used.UserID)
+	if err != nil || user.Active == 0 {
+		app.errorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	auditActor(r, user.ID, user.Email)
+
+	token, err := app.models.Token.GenerateToken(user.ID, app.config.accessTokenTTL)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	token.Email = user.Email
+	token.UserAgent = r.UserAgent()
+	token.IPAddress = app.clientIP(r)
+
+	// the family keeps the expiry of the original login
+	next, err := app.models.RefreshToken.GenerateRefreshToken(user.ID, used.FamilyID, time.Until(used.Expiry))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.RefreshToken.Rotate(r.Context(), *used, *token, *next)
+	if err != nil {
+		if errors.Is(err, data.ErrRefreshTokenReused) {
+			app.errorJSON(w, errors.New("refresh token already used, please log in again"), http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "token refreshed",
+		Data:    envelope{"token": token, "refresh_token": next},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	err := app.readJSON(w, r, &requestPayload)
@@ -95,12 +271,26 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Token.DeleteByToken(requestPayload.Token)
+	if token, err := app.models.Token.GetUserByToken(r.Context(), requestPayload.Token); err == nil {
+		auditActor(r, token.UserID, token.Email)
+		auditTarget(r, "user", token.UserID)
+	}
+
+	err = app.models.Token.DeleteByToken(r.Context(), requestPayload.Token)
 	if err != nil {
 		app.errorJSON(w, errors.New("invalid json"))
 		return
 	}
 
+	if requestPayload.RefreshToken != "" {
+		if rt, err := app.models.RefreshToken.GetByToken(r.Context(), requestPayload.RefreshToken); err == nil {
+			if err := app.models.RefreshToken.RevokeFamily(r.Context(), rt.FamilyID); err != nil {
+				app.errorJSON(w, err)
+				return
+			}
+		}
+	}
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "logged out",
@@ -110,13 +300,121 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// passwordResetTTL is how long an emailed reset link stays valid
+const passwordResetTTL = time.Hour
+
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, errors.New("invalid json"))
+		return
+	}
+
+	auditActor(r, 0, requestPayload.Email)
+
+	// the response is the same whether or not the account exists, so this
+	// endpoint cannot be used to find out who has one
+	payload := jsonResponse{
+		Error:   false,
+		Message: "if an account exists for that email, a reset link has been sent",
+	}
+
+	user, err := app.models.User.GetUserByEmail(r.Context(), requestPayload.Email)
+	if err != nil || user.Active == 0 {
+		_ = app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	auditActor(r, user.ID, user.Email)
+	auditTarget(r, "user", user.ID)
+
+	reset, err := app.models.PasswordReset.GeneratePasswordReset(user.ID, passwordResetTTL)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.models.PasswordReset.Insert(r.Context(), *reset); err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(mailer.Message{
+			To:       user.Email,
+			Template: "password_reset.tmpl",
+			Data: map[string]interface{}{
+				"Name":      user.FirstName,
+				"URL":       fmt.Sprintf("%s/reset-password?token=%s", app.config.frontendURL, url.QueryEscape(reset.Token)),
+				"ExpiresIn": "1 hour",
+			},
+		})
+		if err != nil {
+			app.errorLog.Println("sending password reset email:", err)
+		}
+	})
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, errors.New("invalid json"))
+		return
+	}
+
+	if len(requestPayload.Password) < 8 {
+		app.errorJSON(w, errors.New("password must be at least 8 characters"))
+		return
+	}
+
+	userID, err := app.models.PasswordReset.Consume(r.Context(), requestPayload.Token)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset link"))
+		return
+	}
+
+	auditTarget(r, "user", userID)
+	if user, err := app.models.User.GetUserById(r.Context(), userID); err == nil {
+		auditActor(r, user.ID, user.Email)
+	} else {
+		auditActor(r, userID, "")
+	}
+
+	if err := app.models.User.ResetUserPassword(r.Context(), userID, requestPayload.Password); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// whoever knew the old password should not stay logged in
+	if err := app.models.Token.DeleteTokenForUser(r.Context(), userID); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "password has been reset, please log in",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	app.infoLog.Println("all users")
-	var users data.User
-	all, err := users.GetAllUsers()
+	all, err := app.models.User.GetAllUsers(r.Context())
 
 	if err != nil {
 		app.errorLog.Println(err)
+		app.errorJSON(w, err)
 		return
 	}
 
@@ -138,35 +436,67 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Role != "" && !data.ValidRole(user.Role) {
+		app.errorJSON(w, errors.New("invalid role"))
+		return
+	}
+
+	var before envelope
 	if user.ID == 0 {
 		// save new user
-		if _, err := app.models.User.AddUser(user); err != nil {
-			if err != nil {
-				app.errorJSON(w, err)
-				return
-			}
+		user.ID, err = app.models.User.AddUser(r.Context(), user)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
 		}
 	} else {
-		// update user
-		u, err := app.models.User.GetUserById(user.ID)
+		// update user, from the version the editor read
+		version, ifMatch, err := expectedVersion(r, user.Version)
+		if err != nil {
+			app.versionError(w, err)
+			return
+		}
+
+		u, err := app.models.User.GetUserById(r.Context(), user.ID)
 		if err != nil {
 			app.errorJSON(w, err)
 			return
 		}
+		before = userSummary(u)
+		u.Version = version
 
 		u.Email = user.Email
 		u.FirstName = user.FirstName
 		u.LastName = user.LastName
 		u.Active = user.Active
 
-		if err := u.UpdateUser(); err != nil {
+		if user.Role != "" && user.Role != u.Role {
+			// stops admins from locking themselves out by accident
+			if u.ID == app.authenticatedUser(r).ID {
+				app.errorJSON(w, errors.New("you cannot change your own role"), http.StatusForbidden)
+				return
+			}
+			u.Role = user.Role
+		}
+
+		_, err = app.models.User.UpdateUser(r.Context(), *u)
+		if errors.Is(err, data.ErrEditConflict) {
+			current, err := app.models.User.GetUserById(r.Context(), u.ID)
+			if err != nil {
+				app.errorJSON(w, err)
+				return
+			}
+			current.Password = ""
+			app.editConflict(w, ifMatch, "user", current, current.Version)
+			return
+		} else if err != nil {
 			app.errorJSON(w, err)
 			return
 		}
 
 		// update password
 		if user.Password != "" {
-			err := u.ResetUserPassword(user.Password)
+			err := app.models.User.ResetUserPassword(r.Context(), u.ID, user.Password)
 			if err != nil {
 				app.errorJSON(w, err)
 				return
@@ -175,13 +505,22 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	saved, err := app.models.User.GetUserById(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "user", saved.ID)
+	app.auditChange(r, before, userSummary(saved))
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "Changes saved!",
+		Data:    envelope{"id": saved.ID, "version": saved.Version},
 	}
 
-	_ = app.writeJSON(w, http.StatusAccepted, payload)
-
+	_ = app.writeJSON(w, http.StatusAccepted, payload, versionHeader(saved.Version))
 }
 
 func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
@@ -189,14 +528,16 @@ func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	user, err := app.models.User.GetUserById(id)
+	user, err := app.models.User.GetUserById(r.Context(), id)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, user)
+	_ = app.writeJSON(w, http.StatusOK, user, versionHeader(user.Version))
 }
 
 func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
@@ -207,16 +548,26 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	err := app.readJSON(w, r, &payloadId)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	err = app.models.User.DeleteUserById(payloadId.ID)
-	if err != nil {
+	auditTarget(r, "user", payloadId.ID)
+	if user, err := app.models.User.GetUserById(r.Context(), payloadId.ID); err == nil {
+		app.auditChange(r, userSummary(user), nil)
+	}
+
+	err = app.models.User.DeleteUserById(r.Context(), payloadId.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
 	payload := jsonResponse{
 		Error:   false,
-		Message: "User deleted",
+		Message: "User moved to trash",
 	}
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
@@ -230,20 +581,24 @@ func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.
 		return
 	}
 
-	user, err := app.models.User.GetUserById(userId)
+	user, err := app.models.User.GetUserById(r.Context(), userId)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
+	before := userSummary(user)
+
 	user.Active = 0
-	err = user.UpdateUser()
+	user.Version, err = app.models.User.UpdateUser(r.Context(), *user)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	err = app.models.Token.DeleteTokenForUser(userId)
+	app.auditChange(r, before, userSummary(user))
+
+	err = app.models.Token.DeleteTokenForUser(r.Context(), userId)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -257,6 +612,132 @@ func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.
 	app.writeJSON(w, http.StatusOK, payload)
 }
 
+func (app *application) UserSessions(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	sessions, err := app.models.Token.SessionsForUser(r.Context(), userId)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"sessions": sessions},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		UserID    int    `json:"user_id"`
+		SessionID string `json:"session_id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "session", requestPayload.SessionID)
+	app.auditChange(r, envelope{"user_id": requestPayload.UserID}, nil)
+
+	err := app.models.Token.DeleteSession(r.Context(), requestPayload.UserID, requestPayload.SessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("session not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Session revoked",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "user", userId)
+	var before envelope
+	if sessions, err := app.models.Token.SessionsForUser(r.Context(), userId); err == nil {
+		before = envelope{"sessions": len(sessions)}
+	}
+
+	if err := app.models.Token.DeleteTokenForUser(r.Context(), userId); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.auditChange(r, before, envelope{"sessions": 0})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "All sessions revoked",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) LockedLogins(w http.ResponseWriter, r *http.Request) {
+	attempts, err := app.models.LoginAttempt.AllLocked(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"lockouts": attempts},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Key string `json:"key"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "lockout", requestPayload.Key)
+	if attempt, err := app.models.LoginAttempt.Get(r.Context(), requestPayload.Key); err == nil {
+		app.auditChange(r, envelope{"failures": attempt.Failures, "locked_until": attempt.LockedUntil}, nil)
+	}
+
+	if err := app.models.LoginAttempt.Reset(r.Context(), requestPayload.Key); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Login unlocked",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
 func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
 		Token string `json:"token"`
@@ -270,7 +751,7 @@ func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request) {
 
 	valid := false
 
-	valid, _ = app.models.Token.ValidToken(requestPayload.Token)
+	valid, _ = app.models.Token.ValidToken(r.Context(), requestPayload.Token)
 
 	payload := jsonResponse{
 		Error: false,
@@ -281,28 +762,99 @@ func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request) {
 }
 
 // Books
+// AllBooks returns one page of books. They can be filtered by genre ids,
+// author id, publication year range and slug prefix, and sorted by several
+// keys such as ?sort=-publication_year,title.
 func (app *application) AllBooks(w http.ResponseWriter, r *http.Request) {
-	books, err := app.models.Book.GetAll()
+	filter, err := readBookFilter(r.URL.Query())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeBooks(w, r, filter)
+}
+
+// readBookFilter reads the listing parameters AllBooks accepts
+func readBookFilter(qs url.Values) (data.BookFilter, error) {
+	var filter data.BookFilter
+	var err error
+
+	filter.Page, err = readInt(qs, "page", 1)
+	if err != nil {
+		return filter, err
+	}
+	filter.PageSize, err = readInt(qs, "page_size", 20)
+	if err != nil {
+		return filter, err
+	}
+	filter.AuthorID, err = readInt(qs, "author", 0)
+	if err != nil {
+		return filter, err
+	}
+	filter.YearMin, err = readInt(qs, "year_min", 0)
+	if err != nil {
+		return filter, err
+	}
+	filter.YearMax, err = readInt(qs, "year_max", 0)
+	if err != nil {
+		return filter, err
+	}
+
+	for _, value := range readCSV(qs, "genre") {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, errors.New("genre must be a list of genre ids")
+		}
+		filter.GenreIDs = append(filter.GenreIDs, id)
+	}
 
+	filter.SlugPrefix = qs.Get("slug_prefix")
+	filter.Sort = readCSV(qs, "sort")
+
+	return filter, filter.Validate()
+}
+
+// writeBooks responds with the page of books matching filter, with its
+// pagination metadata and Link header
+func (app *application) writeBooks(w http.ResponseWriter, r *http.Request, filter data.BookFilter) {
+	books, total, err := app.models.Book.GetAllFiltered(r.Context(), filter)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
+	if err := app.resolveCovers(r.Context(), books...); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	metadata := newPaginationMetadata(filter.Page, filter.PageSize, total)
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "success",
-		Data:    envelope{"books": books},
+		Data:    envelope{"books": books, "metadata": metadata},
 	}
 
-	app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusOK, payload, paginationHeaders(r, metadata))
 }
 
+// OneBook returns the book at slug. Slugs a book had before it was renamed
+// answer with a permanent redirect to its current one.
 func (app *application) OneBook(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
 
-	book, err := app.models.Book.GetOneBySlug(slug)
-	if err != nil {
+	book, err := app.models.Book.GetOneBySlug(r.Context(), slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.redirectBook(w, r, slug)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.resolveCovers(r.Context(), book); err != nil {
 		app.errorJSON(w, err)
 		return
 	}
@@ -313,11 +865,79 @@ func (app *application) OneBook(w http.ResponseWriter, r *http.Request) {
 		Data:    envelope{"book": book},
 	}
 
+	app.writeJSON(w, http.StatusOK, payload, versionHeader(book.Version))
+}
+
+// redirectBook points a request for a book's old slug at its current one,
+// with the canonical url in both the Location header and the body
+func (app *application) redirectBook(w http.ResponseWriter, r *http.Request, oldSlug string) {
+	slug, err := app.models.Book.CurrentSlug(r.Context(), oldSlug)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	canonical := "/api/books/" + url.PathEscape(slug)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "book has moved",
+		Data:    envelope{"slug": slug, "canonical": canonical},
+	}
+
+	app.writeJSON(w, http.StatusMovedPermanently, payload, http.Header{"Location": []string{canonical}})
+}
+
+// searchResultsLimit caps how many results a single search returns
+const searchResultsLimit = 100
+
+// SearchBooks ranks books by how well their title, author and description
+// match q. Quoted words are searched as a phrase and a trailing * matches
+// any word starting with what comes before it.
+func (app *application) SearchBooks(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		app.errorJSON(w, errors.New("a search query is required"))
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > searchResultsLimit {
+			app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", searchResultsLimit))
+			return
+		}
+		limit = n
+	}
+
+	results, err := app.models.Book.Search(r.Context(), q, limit)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	for _, result := range results {
+		if err := app.resolveCovers(r.Context(), result.Book); err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"books": results},
+	}
+
 	app.writeJSON(w, http.StatusOK, payload)
 }
 
 func (app *application) AllAuthors(w http.ResponseWriter, r *http.Request) {
-	authors, err := app.models.Author.All()
+	authors, err := app.models.Author.All(r.Context())
 
 	if err != nil {
 		app.errorJSON(w, err)
@@ -352,6 +972,15 @@ func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
 		Description     string `json:"description"`
 		CoverBase64     string `json:"cover"`
 		GenreIDs        []int  `json:"genre_ids"`
+		// Version is the version of the book being edited, unless it is sent
+		// in the If-Match header
+		Version int `json:"version"`
+		// Contributors lists everyone credited in order, when it is left out
+		// an update keeps the book's current contributors
+		Contributors []struct {
+			AuthorID int    `json:"author_id"`
+			Role     string `json:"role"`
+		} `json:"contributors"`
 	}
 
 	if err := app.readJSON(w, r, &requestPayload); err != nil {
@@ -359,16 +988,58 @@ func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var contributors []data.Contributor
+	if requestPayload.Contributors != nil {
+		contributors = []data.Contributor{}
+	}
+	hasAuthor := requestPayload.AuthorID != 0
+	for _, c := range requestPayload.Contributors {
+		if c.Role != "" && !data.ValidContributorRole(c.Role) {
+			app.errorJSON(w, fmt.Errorf("unknown contributor role %q", c.Role))
+			return
+		}
+		if c.Role == "" || c.Role == data.ContributorAuthor {
+			hasAuthor = true
+		}
+		contributors = append(contributors, data.Contributor{AuthorID: c.AuthorID, Role: c.Role})
+	}
+
+	if !hasAuthor {
+		app.errorJSON(w, errors.New("a book needs an author"))
+		return
+	}
+
 	book := data.Book{
 		ID:              requestPayload.ID,
 		Title:           requestPayload.Title,
 		AuthorID:        requestPayload.AuthorID,
 		PublicationYear: requestPayload.PublicationYear,
 		Description:     requestPayload.Description,
-		Slug:            slugify.Slugify(requestPayload.Title),
 		GenreIDs:        requestPayload.GenreIDs,
+		Contributors:    contributors,
 	}
 
+	// an existing book is saved only over the version the editor read
+	var err error
+	var ifMatch bool
+	var before envelope
+	if book.ID != 0 {
+		book.Version, ifMatch, err = expectedVersion(r, requestPayload.Version)
+		if err != nil {
+			app.versionError(w, err)
+			return
+		}
+
+		auditTarget(r, "book", book.ID)
+		if current, err := app.models.Book.GetOneById(r.Context(), book.ID); err == nil {
+			before = bookSummary(current)
+		}
+	}
+
+	// a new cover is checked before anything is saved
+	var cleaned []byte
+	var ext string
+	var img image.Image
 	if len(requestPayload.CoverBase64) > 0 {
 		decoded, err := base64.StdEncoding.DecodeString(requestPayload.CoverBase64)
 		if err != nil {
@@ -376,34 +1047,110 @@ func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := os.WriteFile(fmt.Sprintf("%s/covers/%s.jpg", staticPath, book.Slug), decoded, 0666); err != nil {
-			app.errorJSON(w, err)
+		cleaned, ext, img, err = cleanCover(decoded)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusUnprocessableEntity)
 			return
 		}
 	}
 
-	if book.ID == 0 {
-		// add book
-		_, err := app.models.Book.Insert(book)
+	// the cover is stored under a name of its own before the book is saved,
+	// with the book in one write, and deleted again if the save fails. A new
+	// book has its id reserved to name the cover after.
+	newBook := book.ID == 0
+	var cover *processedCover
+	var previous *data.Book
+	if img != nil {
+		if newBook {
+			book.ID, err = app.models.Book.NextID(r.Context())
+		} else {
+			previous, err = app.models.Book.GetOneById(r.Context(), book.ID)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+			return
+		} else if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		cover, err = processCover(book.ID, cleaned, ext, img)
 		if err != nil {
 			app.errorJSON(w, err)
 			return
 		}
+
+		book.Cover = cover.name
+		book.Covers = cover.covers
+		if err := app.storeCover(r.Context(), cover); err != nil {
+			app.removeCover(r.Context(), cover.name, cover.covers)
+			app.errorJSON(w, fmt.Errorf("storing cover: %w", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if newBook {
+		// add book
+		book.ID, err = app.models.Book.Insert(r.Context(), book)
 	} else {
 		// update book
-		if err := book.Update(); err != nil {
-			app.errorJSON(w, err)
+		err = app.models.Book.Update(r.Context(), book)
+	}
+
+	if err != nil {
+		if cover != nil {
+			app.removeCover(r.Context(), cover.name, cover.covers)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, data.ErrEditConflict) {
+			app.bookConflict(w, r, ifMatch, book.ID)
 			return
 		}
+		app.errorJSON(w, err)
+		return
+	}
 
+	if previous != nil {
+		app.removeCover(r.Context(), previous.Cover, previous.Covers)
+	}
+
+	// the store may have numbered the slug to keep it unique
+	saved, err := app.models.Book.GetOneById(r.Context(), book.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
 	}
 
+	auditTarget(r, "book", saved.ID)
+	app.auditChange(r, before, bookSummary(saved))
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "Changes Saved",
+		Data:    envelope{"id": saved.ID, "slug": saved.Slug, "version": saved.Version},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload, versionHeader(saved.Version))
+}
+
+// bookConflict answers a save of a stale version of a book with the book as
+// it is now
+func (app *application) bookConflict(w http.ResponseWriter, r *http.Request, ifMatch bool, id int) {
+	current, err := app.models.Book.GetOneById(r.Context(), id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
 	}
 
-	app.writeJSON(w, http.StatusAccepted, payload)
+	if err := app.resolveCovers(r.Context(), current); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.editConflict(w, ifMatch, "book", current, current.Version)
 }
 
 func (app *application) BookById(w http.ResponseWriter, r *http.Request) {
@@ -414,19 +1161,24 @@ func (app *application) BookById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	book, err := app.models.Book.GetOneById(bookId)
+	book, err := app.models.Book.GetOneById(r.Context(), bookId)
 
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
+	if err := app.resolveCovers(r.Context(), book); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
 	payload := jsonResponse{
 		Error: false,
 		Data:  book,
 	}
 
-	app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusOK, payload, versionHeader(book.Version))
 }
 
 func (app *application) BookDelete(w http.ResponseWriter, r *http.Request) {
@@ -439,14 +1191,23 @@ func (app *application) BookDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := app.models.Book.DeleteByID(requestPayload.ID); err != nil {
+	auditTarget(r, "book", requestPayload.ID)
+	if book, err := app.models.Book.GetOneById(r.Context(), requestPayload.ID); err == nil {
+		app.auditChange(r, bookSummary(book), nil)
+	}
+
+	err := app.models.Book.DeleteByID(r.Context(), requestPayload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
 	payload := jsonResponse{
 		Error:   false,
-		Message: "Book Deleted",
+		Message: "Book moved to trash",
 	}
 
 	app.writeJSON(w, http.StatusOK, payload)
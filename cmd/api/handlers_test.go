@@ -0,0 +1,990 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-api/internal/data"
+	"go-api/internal/mailer"
+	"go-api/internal/storage"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestApp returns the api backed by the in-memory demo store, with covers
+// kept in a temporary directory, so handlers can be tested without services
+func newTestApp(t *testing.T) (*application, http.Handler) {
+	t.Helper()
+
+	var cfg config
+	cfg.accessTokenTTL = 15 * time.Minute
+	cfg.refreshTokenTTL = time.Hour
+	cfg.frontendURL = "http://localhost:8080"
+	cfg.mfaIssuer = "Go API"
+	cfg.trashRetention = 24 * time.Hour
+
+	app := &application{
+		config:   cfg,
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		models:   data.NewMemoryDemo(),
+		mailer:   mailer.New("localhost", 1025, "", "", "Go API <no-reply@example.com>"),
+		storage:  storage.NewLocal(t.TempDir(), "/static"),
+	}
+
+	return app, app.routes()
+}
+
+// testResponse is a response as the client sees it
+type testResponse struct {
+	Status  int
+	Header  http.Header
+	Error   bool            `json:"error"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// call sends body as json to the api and decodes the response, token is
+// sent as a bearer token unless it is empty
+func call(t *testing.T, h http.Handler, method, path, token string, body interface{}, header ...string) testResponse {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+
+	return send(t, h, req, token, header...)
+}
+
+// upload posts file as the multipart field name, with fields beside it, and
+// decodes the response like call
+func upload(t *testing.T, h http.Handler, path, token, name string, file []byte, fields map[string]string, header ...string) testResponse {
+	t.Helper()
+
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := form.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := form.CreateFormFile(name, name+".jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", path, &buf)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return send(t, h, req, token, header...)
+}
+
+// send serves req with the token and header pairs added
+func send(t *testing.T, h http.Handler, req *http.Request, token string, header ...string) testResponse {
+	t.Helper()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	res := testResponse{Status: rr.Code, Header: rr.Header()}
+	if rr.Body.Len() > 0 {
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s %s: cannot decode %q: %v", req.Method, req.URL.Path, rr.Body.String(), err)
+		}
+	}
+
+	return res
+}
+
+// decode reads the data of a response into v
+func (res testResponse) decode(t *testing.T, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(res.Data, v); err != nil {
+		t.Fatalf("cannot decode %s: %v", res.Data, err)
+	}
+}
+
+// expect fails the test unless the response has status
+func (res testResponse) expect(t *testing.T, status int) testResponse {
+	t.Helper()
+
+	if res.Status != status {
+		t.Fatalf("status = %d, want %d: %s", res.Status, status, res.Message)
+	}
+	return res
+}
+
+// login logs in and returns the access token
+func login(t *testing.T, h http.Handler, email, password string) string {
+	t.Helper()
+
+	res := call(t, h, "POST", "/api/login", "", envelope{"email": email, "password": password}).expect(t, http.StatusOK)
+
+	var body struct {
+		Token struct {
+			Token string `json:"token"`
+		} `json:"token"`
+	}
+	res.decode(t, &body)
+
+	if body.Token.Token == "" {
+		t.Fatal("login returned no token")
+	}
+	return body.Token.Token
+}
+
+func TestLogin(t *testing.T) {
+	_, h := newTestApp(t)
+
+	res := call(t, h, "POST", "/api/login", "", envelope{"email": data.DemoEmail, "password": data.DemoPassword}).
+		expect(t, http.StatusOK)
+
+	var body struct {
+		Token        data.Token        `json:"token"`
+		RefreshToken data.RefreshToken `json:"refresh_token"`
+		User         data.User         `json:"user"`
+		Permissions  []string          `json:"permissions"`
+	}
+	res.decode(t, &body)
+
+	if body.Token.Token == "" || body.RefreshToken.Token == "" {
+		t.Fatal("login did not return both tokens")
+	}
+	if body.User.Email != data.DemoEmail || body.User.Role != data.RoleAdmin {
+		t.Fatalf("logged in as %s (%s), want %s (admin)", body.User.Email, body.User.Role, data.DemoEmail)
+	}
+	if len(body.Permissions) == 0 {
+		t.Fatal("login returned no permissions")
+	}
+
+	call(t, h, "POST", "/api/validate-token", "", envelope{"token": body.Token.Token}).expect(t, http.StatusOK)
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+	}{
+		{"wrong password", data.DemoEmail, "not the password"},
+		{"unknown email", "nobody@example.com", data.DemoPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := call(t, h, "POST", "/api/login", "", envelope{"email": tt.email, "password": tt.password}).
+				expect(t, http.StatusBadRequest)
+
+			if res.Message != "invalid email or password" {
+				t.Fatalf("message = %q", res.Message)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	_, h := newTestApp(t)
+
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+	call(t, h, "POST", "/api/admin/users", token, nil).expect(t, http.StatusOK)
+
+	call(t, h, "POST", "/api/logout", "", envelope{"token": token}).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/admin/users", token, nil).expect(t, http.StatusUnauthorized)
+}
+
+func TestBookCRUD(t *testing.T) {
+	_, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	var saved struct {
+		ID      int    `json:"id"`
+		Slug    string `json:"slug"`
+		Version int    `json:"version"`
+	}
+
+	book := envelope{
+		"title":            "Carrie",
+		"author_id":        1,
+		"publication_year": 1974,
+		"description":      "Carrie by Stephen King.",
+		"genre_ids":        []int{1},
+	}
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	if saved.ID == 0 || saved.Slug != "carrie" || saved.Version != 1 {
+		t.Fatalf("saved %+v, want a new book carrie at version 1", saved)
+	}
+
+	var one struct {
+		Book data.Book `json:"book"`
+	}
+	call(t, h, "GET", "/api/books/carrie", "", nil).expect(t, http.StatusOK).decode(t, &one)
+
+	if one.Book.Title != "Carrie" || one.Book.Author.AuthorName != "Stephen King" || len(one.Book.Genres) != 1 {
+		t.Fatalf("read back %+v", one.Book)
+	}
+
+	// an update must say which version it was made from
+	book["id"] = saved.ID
+	book["publication_year"] = 1975
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusPreconditionRequired)
+
+	book["version"] = saved.Version
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	if saved.Version != 2 {
+		t.Fatalf("version after update = %d, want 2", saved.Version)
+	}
+
+	// saving over the version that was just replaced is a conflict
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusConflict)
+	call(t, h, "POST", "/api/admin/books/save", token, book, "If-Match", `"1"`).expect(t, http.StatusPreconditionFailed)
+
+	res := call(t, h, "POST", fmt.Sprintf("/api/admin/books/%d", saved.ID), token, nil).expect(t, http.StatusOK)
+	if etag := res.Header.Get("ETag"); etag != `"2"` {
+		t.Fatalf("ETag = %s, want \"2\"", etag)
+	}
+
+	var updated data.Book
+	res.decode(t, &updated)
+	if updated.PublicationYear != 1975 {
+		t.Fatalf("publication year = %d, want 1975", updated.PublicationYear)
+	}
+
+	call(t, h, "POST", "/api/admin/books/delete", token, envelope{"id": saved.ID}).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/admin/books/delete", token, envelope{"id": saved.ID}).expect(t, http.StatusNotFound)
+	call(t, h, "GET", "/api/books/carrie", "", nil).expect(t, http.StatusNotFound)
+
+	call(t, h, "POST", "/api/admin/books/restore", token, envelope{"id": saved.ID}).expect(t, http.StatusOK)
+	call(t, h, "GET", "/api/books/carrie", "", nil).expect(t, http.StatusOK)
+}
+
+func TestBookWithCover(t *testing.T) {
+	app, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+	ctx := context.Background()
+
+	book := envelope{
+		"title":            "Christine",
+		"author_id":        1,
+		"publication_year": 1983,
+		"genre_ids":        []int{1},
+		"cover":            base64.StdEncoding.EncodeToString(testJPEG(t, 400, 600)),
+	}
+
+	// the cover of a new book is saved with it, as its first version
+	var saved struct {
+		ID      int `json:"id"`
+		Version int `json:"version"`
+	}
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	created, err := app.models.Book.GetOneById(ctx, saved.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyedByBook(created.Cover, saved.ID) || saved.Version != 1 {
+		t.Fatalf("cover %q at version %d, want one kept under book %d at version 1", created.Cover, saved.Version, saved.ID)
+	}
+	if _, err := app.storage.Get(ctx, coverKey(created.Cover)); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := app.models.Book.Revisions(ctx, saved.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Action != data.RevisionCreate {
+		t.Fatalf("%d revisions, want the one of the create", len(revisions))
+	}
+
+	// a book whose cover cannot be stored is not saved at all
+	app.storage = failingStorage{app.storage}
+	book["title"] = "Cujo"
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusInternalServerError)
+	call(t, h, "GET", "/api/books/cujo", "", nil).expect(t, http.StatusNotFound)
+
+	books, err := app.models.Book.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range books {
+		if b.Title == "Cujo" {
+			t.Fatal("book saved without its cover")
+		}
+	}
+}
+
+func TestOldSlugRedirects(t *testing.T) {
+	_, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	var saved struct {
+		ID      int    `json:"id"`
+		Slug    string `json:"slug"`
+		Version int    `json:"version"`
+	}
+
+	book := envelope{"title": "Pet Sematary", "author_id": 1, "publication_year": 1983}
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	for _, title := range []string{"Pet Sematary: Revised", "Pet Sematary (2019)"} {
+		book["id"], book["title"], book["version"] = saved.ID, title, saved.Version
+		call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+	}
+
+	tests := []struct {
+		slug   string
+		status int
+	}{
+		{"pet-sematary-2019", http.StatusOK},
+		{"pet-sematary", http.StatusMovedPermanently},
+		{"pet-sematary-revised", http.StatusMovedPermanently},
+		{"pet-sematary-1989", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		res := call(t, h, "GET", "/api/books/"+tt.slug, "", nil).expect(t, tt.status)
+		if tt.status != http.StatusMovedPermanently {
+			continue
+		}
+
+		var moved struct {
+			Slug      string `json:"slug"`
+			Canonical string `json:"canonical"`
+		}
+		res.decode(t, &moved)
+
+		if location := res.Header.Get("Location"); location != "/api/books/pet-sematary-2019" || moved.Canonical != location || moved.Slug != "pet-sematary-2019" {
+			t.Fatalf("%s moved to %q, body %+v", tt.slug, location, moved)
+		}
+	}
+}
+
+func TestRevertBookVersions(t *testing.T) {
+	_, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	var saved struct {
+		ID      int `json:"id"`
+		Version int `json:"version"`
+	}
+
+	book := envelope{"title": "Firestarter", "author_id": 1, "publication_year": 1980}
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	book["id"], book["version"], book["publication_year"] = saved.ID, saved.Version, 1981
+	call(t, h, "POST", "/api/admin/books/save", token, book).expect(t, http.StatusAccepted).decode(t, &saved)
+
+	path := fmt.Sprintf("/api/admin/books/revisions/%d/revert", saved.ID)
+
+	tests := []struct {
+		name   string
+		body   envelope
+		header []string
+		status int
+	}{
+		{"no version", envelope{"revision": 1}, nil, http.StatusPreconditionRequired},
+		{"stale version", envelope{"revision": 1, "version": 1}, nil, http.StatusConflict},
+		{"stale If-Match", envelope{"revision": 1}, []string{"If-Match", `"1"`}, http.StatusPreconditionFailed},
+		{"malformed If-Match", envelope{"revision": 1}, []string{"If-Match", "latest"}, http.StatusBadRequest},
+		{"unknown revision", envelope{"revision": 9, "version": 2}, nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call(t, h, "POST", path, token, tt.body, tt.header...).expect(t, tt.status)
+		})
+	}
+
+	res := call(t, h, "POST", path, token, envelope{"revision": 1}, "If-Match", `"2"`).expect(t, http.StatusOK)
+	if etag := res.Header.Get("ETag"); etag != `"3"` {
+		t.Fatalf("ETag = %s, want \"3\"", etag)
+	}
+
+	var reverted struct {
+		Book data.Book `json:"book"`
+	}
+	res.decode(t, &reverted)
+	if reverted.Book.PublicationYear != 1980 || reverted.Book.Version != 3 {
+		t.Fatalf("reverted to %d at version %d, want 1980 at 3", reverted.Book.PublicationYear, reverted.Book.Version)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	_, h := newTestApp(t)
+	admin := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	call(t, h, "POST", "/api/admin/users", "", nil).expect(t, http.StatusUnauthorized)
+	call(t, h, "POST", "/api/admin/users", "not-a-token", nil).expect(t, http.StatusUnauthorized)
+
+	var list struct {
+		Users []data.User `json:"users"`
+	}
+	call(t, h, "POST", "/api/admin/users", admin, nil).expect(t, http.StatusOK).decode(t, &list)
+
+	if len(list.Users) != 1 || list.Users[0].Email != data.DemoEmail || list.Users[0].Role != data.RoleAdmin {
+		t.Fatalf("users = %+v, want only the demo admin", list.Users)
+	}
+
+	viewer := envelope{
+		"email":      "viewer@example.com",
+		"first_name": "View",
+		"last_name":  "Er",
+		"password":   "viewer-password",
+		"active":     1,
+		"role":       data.RoleViewer,
+	}
+	call(t, h, "POST", "/api/admin/users/save", admin, viewer).expect(t, http.StatusAccepted)
+
+	token := login(t, h, "viewer@example.com", "viewer-password")
+
+	tests := []struct {
+		name   string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"viewer reads a book", "/api/admin/books/1", nil, http.StatusOK},
+		{"viewer lists users", "/api/admin/users", nil, http.StatusForbidden},
+		{"viewer saves a book", "/api/admin/books/save", envelope{"id": 1, "title": "x", "author_id": 1, "version": 1}, http.StatusForbidden},
+		{"viewer deletes a book", "/api/admin/books/delete", envelope{"id": 1}, http.StatusForbidden},
+		{"viewer reads the audit log", "/api/admin/audit", nil, http.StatusForbidden},
+		{"viewer purges the trash", "/api/admin/trash/purge", nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call(t, h, "POST", tt.path, token, tt.body).expect(t, tt.status)
+		})
+	}
+
+	call(t, h, "POST", "/api/admin/users", admin, nil).expect(t, http.StatusOK).decode(t, &list)
+	if len(list.Users) != 2 {
+		t.Fatalf("%d users, want 2", len(list.Users))
+	}
+
+	// the book a viewer could not delete is still there
+	call(t, h, "GET", "/api/books/salem-s-lot", "", nil).expect(t, http.StatusOK)
+}
+
+func TestTrashedUserEmail(t *testing.T) {
+	app, h := newTestApp(t)
+	admin := login(t, h, data.DemoEmail, data.DemoPassword)
+	ctx := context.Background()
+
+	user := envelope{
+		"email":      "leaver@example.com",
+		"first_name": "Lea",
+		"last_name":  "Ver",
+		"password":   "leaver-password",
+		"active":     1,
+		"role":       data.RoleViewer,
+	}
+	register := func() int {
+		t.Helper()
+		call(t, h, "POST", "/api/admin/users/save", admin, user).expect(t, http.StatusAccepted)
+		saved, err := app.models.User.GetUserByEmail(ctx, "leaver@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved.ID
+	}
+
+	first := register()
+	call(t, h, "POST", "/api/admin/users/save", admin, user).expect(t, http.StatusForbidden)
+	call(t, h, "POST", "/api/admin/users/delete", admin, envelope{"id": first}).expect(t, http.StatusOK)
+
+	// the email is free again once its user is in the trash
+	second := register()
+	call(t, h, "POST", "/api/admin/users/restore", admin, envelope{"id": first}).expect(t, http.StatusConflict)
+
+	call(t, h, "POST", "/api/admin/users/delete", admin, envelope{"id": second}).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/admin/users/restore", admin, envelope{"id": first}).expect(t, http.StatusOK)
+	login(t, h, "leaver@example.com", "leaver-password")
+}
+
+func TestAuthorSlugsAndPhotos(t *testing.T) {
+	app, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	var first, second struct {
+		ID   int    `json:"id"`
+		Slug string `json:"slug"`
+	}
+
+	// a name another author has gets a numbered slug instead of a conflict
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"author_name": "Richard Bachman"}).
+		expect(t, http.StatusAccepted).decode(t, &first)
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"author_name": "Richard Bachman"}).
+		expect(t, http.StatusAccepted).decode(t, &second)
+
+	if first.Slug != "richard-bachman" || second.Slug != "richard-bachman-2" {
+		t.Fatalf("slugs = %s and %s, want richard-bachman and richard-bachman-2", first.Slug, second.Slug)
+	}
+
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"author_name": "Bachman", "photo": base64.StdEncoding.EncodeToString([]byte("not an image"))}).
+		expect(t, http.StatusUnprocessableEntity)
+
+	photo := envelope{
+		"id":          second.ID,
+		"author_name": "Richard Bachman",
+		"photo":       base64.StdEncoding.EncodeToString(testJPEG(t, 800, 1000)),
+	}
+	call(t, h, "POST", "/api/admin/authors/save", token, photo).expect(t, http.StatusAccepted)
+
+	author, err := app.models.Author.GetOneById(context.Background(), second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(author.Photo, fmt.Sprintf("%d/", second.ID)) || len(author.Photos) != len(coverSizes) {
+		t.Fatalf("photo %q with %d sizes, want one kept under the author id with every size", author.Photo, len(author.Photos))
+	}
+
+	stored, err := app.storage.Get(context.Background(), photoKey(author.Photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Fatalf("stored photo is not a JPEG: %v", err)
+	}
+
+	var page struct {
+		Author data.Author `json:"author"`
+		Photo  string      `json:"photo"`
+	}
+	call(t, h, "GET", "/api/authors/richard-bachman-2", "", nil).expect(t, http.StatusOK).decode(t, &page)
+
+	if page.Photo != "/static/authors/"+author.Photo || page.Author.Photos["thumbnail"].WebP.URL == "" {
+		t.Fatalf("photo url %q, thumbnail %+v", page.Photo, page.Author.Photos["thumbnail"])
+	}
+
+	// a new photo replaces the files of the old one
+	call(t, h, "POST", "/api/admin/authors/save", token, photo).expect(t, http.StatusAccepted)
+	if _, err := app.storage.Get(context.Background(), photoKey(author.Photo)); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("old photo still stored: %v", err)
+	}
+}
+
+func TestAuthorPhotoStorageFails(t *testing.T) {
+	app, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+	ctx := context.Background()
+
+	photo := base64.StdEncoding.EncodeToString(testJPEG(t, 400, 500))
+
+	// a new author gets their photo under the id reserved for them
+	var created struct {
+		ID int `json:"id"`
+	}
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"author_name": "Joe Hill", "photo": photo}).
+		expect(t, http.StatusAccepted).decode(t, &created)
+
+	author, err := app.models.Author.GetOneById(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(author.Photo, fmt.Sprintf("%d/", created.ID)) {
+		t.Fatalf("photo %q is not kept under the author id %d", author.Photo, created.ID)
+	}
+
+	app.storage = failingStorage{app.storage}
+
+	// neither a new author nor the changes to one are saved without the photo
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"author_name": "Owen King", "photo": photo}).
+		expect(t, http.StatusInternalServerError)
+	call(t, h, "POST", "/api/admin/authors/save", token, envelope{"id": created.ID, "author_name": "Joseph Hillstrom King", "photo": photo}).
+		expect(t, http.StatusInternalServerError)
+
+	authors, err := app.models.Author.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range authors {
+		if a.AuthorName == "Owen King" {
+			t.Fatal("author saved without their photo")
+		}
+	}
+
+	unchanged, err := app.models.Author.GetOneById(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.AuthorName != "Joe Hill" || unchanged.Photo != author.Photo {
+		t.Fatalf("author changed to %q with photo %q", unchanged.AuthorName, unchanged.Photo)
+	}
+}
+
+// failingStorage is storage that cannot store anything
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Put(context.Context, string, []byte, string) error {
+	return errors.New("storage unavailable")
+}
+
+// testJPEG returns a JPEG of the given size
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackfillCovers(t *testing.T) {
+	app, _ := newTestApp(t)
+	ctx := context.Background()
+
+	books, err := app.models.Book.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authors, err := app.models.Author.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, author := books[0], authors[0]
+
+	// a cover and photo as they were saved before sizes, named by slug
+	raw := testJPEG(t, 400, 600)
+	legacyCover := book.Slug + ".jpg"
+	legacyPhoto := author.Slug + ".jpg"
+	if err := app.storage.Put(ctx, coverKey(legacyCover), raw, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.storage.Put(ctx, photoKey(legacyPhoto), raw, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Book.SetCover(ctx, book.ID, legacyCover, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.backfillCovers([]string{"backfill"}); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err = app.models.Book.GetOneById(ctx, book.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author, err = app.models.Author.GetOneById(ctx, author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []struct {
+		kind, name, legacy string
+		id                 int
+		sizes              data.CoverSet
+		key                func(string) string
+	}{
+		{"cover", book.Cover, legacyCover, book.ID, book.Covers, coverKey},
+		{"photo", author.Photo, legacyPhoto, author.ID, author.Photos, photoKey},
+	} {
+		if !keyedByBook(file.name, file.id) || len(file.sizes) != len(coverSizes) {
+			t.Fatalf("%s is %q with %d sizes, want it under %d/ with %d", file.kind, file.name, len(file.sizes), file.id, len(coverSizes))
+		}
+
+		saved, err := app.storage.Get(ctx, file.key(file.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(saved, raw) {
+			t.Fatalf("%s was stored as it was, not cleaned", file.kind)
+		}
+
+		if _, err := app.storage.Get(ctx, file.key(file.legacy)); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("legacy %s %s was kept: %v", file.kind, file.legacy, err)
+		}
+	}
+}
+
+func TestUploadCoverVersions(t *testing.T) {
+	app, h := newTestApp(t)
+	token := login(t, h, data.DemoEmail, data.DemoPassword)
+
+	books, err := app.models.Book.GetAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := books[0]
+	path := fmt.Sprintf("/api/admin/books/cover/%d", book.ID)
+	cover := testJPEG(t, 200, 300)
+	current := strconv.Itoa(book.Version)
+	stale := strconv.Itoa(book.Version - 1)
+
+	// a cover must say which version of the book it was chosen for
+	upload(t, h, path, token, "cover", cover, nil).expect(t, http.StatusPreconditionRequired)
+
+	if book.Version > 1 {
+		upload(t, h, path, token, "cover", cover, map[string]string{"version": stale}).expect(t, http.StatusConflict)
+		upload(t, h, path, token, "cover", cover, nil, "If-Match", strconv.Quote(stale)).expect(t, http.StatusPreconditionFailed)
+	}
+
+	res := upload(t, h, path, token, "cover", cover, map[string]string{"version": current}).expect(t, http.StatusAccepted)
+
+	var saved struct {
+		Cover   string `json:"cover"`
+		Version int    `json:"version"`
+	}
+	res.decode(t, &saved)
+
+	if saved.Cover == "" || saved.Version != book.Version+1 {
+		t.Fatalf("saved %+v, want a cover at version %d", saved, book.Version+1)
+	}
+	if etag := res.Header.Get("ETag"); etag != strconv.Quote(strconv.Itoa(saved.Version)) {
+		t.Fatalf("ETag = %s, want %q", etag, strconv.Itoa(saved.Version))
+	}
+
+	// the version the cover replaced is now stale
+	upload(t, h, path, token, "cover", cover, nil, "If-Match", strconv.Quote(current)).expect(t, http.StatusPreconditionFailed)
+	upload(t, h, path, token, "cover", cover, map[string]string{"version": current}).expect(t, http.StatusConflict)
+}
+
+func TestAuditLog(t *testing.T) {
+	app, h := newTestApp(t)
+
+	entries := func(action string) []*data.AuditEntry {
+		t.Helper()
+
+		list, _, err := app.models.Audit.List(context.Background(), data.AuditFilter{Page: 1, PageSize: 100, Action: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	res := call(t, h, "POST", "/api/login", "", envelope{"email": data.DemoEmail, "password": data.DemoPassword}).expect(t, http.StatusOK)
+	var session struct {
+		Token struct {
+			Token string `json:"token"`
+		} `json:"token"`
+		RefreshToken struct {
+			Token string `json:"token"`
+		} `json:"refresh_token"`
+		User data.User `json:"user"`
+	}
+	res.decode(t, &session)
+	admin := session.Token.Token
+
+	viewer := envelope{
+		"email":      "viewer@example.com",
+		"first_name": "View",
+		"last_name":  "Er",
+		"password":   "viewer-password",
+		"active":     1,
+		"role":       data.RoleViewer,
+	}
+	call(t, h, "POST", "/api/admin/users/save", admin, viewer).expect(t, http.StatusAccepted)
+	token := login(t, h, "viewer@example.com", "viewer-password")
+
+	// a request turned away by its permission is not logged as the action
+	call(t, h, "POST", "/api/admin/books/delete", token, envelope{"id": 1}).expect(t, http.StatusForbidden)
+	if list := entries("book.delete"); len(list) != 0 {
+		t.Fatalf("denied delete was audited: %+v", list[0])
+	}
+
+	call(t, h, "POST", "/api/admin/books/delete", admin, envelope{"id": 1}).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/admin/books/restore", admin, envelope{"id": 1}).expect(t, http.StatusOK)
+
+	restores := entries("book.restore")
+	if len(restores) != 1 || restores[0].TargetID != "1" || !strings.Contains(string(restores[0].Before), "deleted_at") || len(restores[0].After) == 0 {
+		t.Fatalf("book restore audited as %+v", restores)
+	}
+
+	users, err := app.models.User.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var viewerID int
+	for _, u := range users {
+		if u.Email == "viewer@example.com" {
+			viewerID = u.ID
+		}
+	}
+	call(t, h, "POST", fmt.Sprintf("/api/admin/users/sessions/revoke-all/%d", viewerID), admin, nil).expect(t, http.StatusOK)
+
+	revokes := entries("user.revoke_sessions")
+	if len(revokes) != 1 || revokes[0].TargetID != strconv.Itoa(viewerID) || string(revokes[0].Before) != `{"sessions":1}` || string(revokes[0].After) != `{"sessions":0}` {
+		t.Fatalf("revoking sessions audited as %+v", revokes)
+	}
+
+	// the routes nobody is logged in to name who the request was for
+	call(t, h, "POST", "/api/token/refresh", "", envelope{"refresh_token": session.RefreshToken.Token}).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/forgot-password", "", envelope{"email": data.DemoEmail}).expect(t, http.StatusAccepted)
+	call(t, h, "POST", "/api/reset-password", "", envelope{"token": "not-a-token", "password": "new-password"}).expect(t, http.StatusBadRequest)
+
+	for _, action := range []string{"user.token_refresh", "user.password_forgot"} {
+		list := entries(action)
+		if len(list) != 1 || list[0].ActorEmail != data.DemoEmail || list[0].TargetID != strconv.Itoa(session.User.ID) {
+			t.Fatalf("%s audited as %+v", action, list)
+		}
+	}
+	if list := entries("user.password_reset"); len(list) != 1 || list[0].Status != http.StatusBadRequest {
+		t.Fatalf("failed password reset audited as %+v", list)
+	}
+}
+
+// loginSession logs in and returns the access and refresh tokens
+func loginSession(t *testing.T, h http.Handler, email, password string) (access, refresh string) {
+	t.Helper()
+
+	res := call(t, h, "POST", "/api/login", "", envelope{"email": email, "password": password}).expect(t, http.StatusOK)
+
+	var body struct {
+		Token struct {
+			Token string `json:"token"`
+		} `json:"token"`
+		RefreshToken struct {
+			Token string `json:"token"`
+		} `json:"refresh_token"`
+	}
+	res.decode(t, &body)
+
+	return body.Token.Token, body.RefreshToken.Token
+}
+
+func TestRefreshToken(t *testing.T) {
+	_, h := newTestApp(t)
+	access, refresh := loginSession(t, h, data.DemoEmail, data.DemoPassword)
+
+	refreshWith := func(token string, status int) (string, string) {
+		t.Helper()
+
+		res := call(t, h, "POST", "/api/token/refresh", "", envelope{"refresh_token": token}).expect(t, status)
+		if status != http.StatusOK {
+			return "", ""
+		}
+
+		var body struct {
+			Token struct {
+				Token string `json:"token"`
+			} `json:"token"`
+			RefreshToken struct {
+				Token string `json:"token"`
+			} `json:"refresh_token"`
+		}
+		res.decode(t, &body)
+		return body.Token.Token, body.RefreshToken.Token
+	}
+
+	call(t, h, "POST", "/api/token/refresh", "", envelope{"refresh_token": "not-a-token"}).expect(t, http.StatusUnauthorized)
+
+	// rotating replaces both tokens of the login
+	nextAccess, nextRefresh := refreshWith(refresh, http.StatusOK)
+	if nextAccess == access || nextRefresh == refresh {
+		t.Fatal("refresh handed back the same tokens")
+	}
+	call(t, h, "POST", "/api/admin/books/1", access, nil).expect(t, http.StatusUnauthorized)
+	call(t, h, "POST", "/api/admin/books/1", nextAccess, nil).expect(t, http.StatusOK)
+
+	// presenting a spent refresh token means it leaked, so the whole login
+	// is revoked, including the tokens handed out in its place
+	refreshWith(refresh, http.StatusUnauthorized)
+	refreshWith(nextRefresh, http.StatusUnauthorized)
+	call(t, h, "POST", "/api/admin/books/1", nextAccess, nil).expect(t, http.StatusUnauthorized)
+
+	// other logins of the same user are left alone
+	otherAccess, otherRefresh := loginSession(t, h, data.DemoEmail, data.DemoPassword)
+	refreshWith(otherRefresh, http.StatusOK)
+	call(t, h, "POST", "/api/admin/books/1", otherAccess, nil).expect(t, http.StatusUnauthorized)
+
+	// logging out revokes the refresh token too
+	access, refresh = loginSession(t, h, data.DemoEmail, data.DemoPassword)
+	call(t, h, "POST", "/api/logout", "", envelope{"token": access, "refresh_token": refresh}).expect(t, http.StatusOK)
+	refreshWith(refresh, http.StatusUnauthorized)
+}
+
+func TestSessions(t *testing.T) {
+	app, h := newTestApp(t)
+	admin, _ := loginSession(t, h, data.DemoEmail, data.DemoPassword)
+
+	users, err := app.models.User.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := users[0].ID
+
+	// a login whose access token has expired is idle, not gone
+	app.config.accessTokenTTL = -time.Minute
+	_, idleRefresh := loginSession(t, h, data.DemoEmail, data.DemoPassword)
+	app.config.accessTokenTTL = 15 * time.Minute
+
+	// logging in again clears out expired access tokens
+	loginSession(t, h, data.DemoEmail, data.DemoPassword)
+
+	sessionsPath := fmt.Sprintf("/api/admin/users/sessions/%d", userID)
+	var list struct {
+		Sessions []data.Session `json:"sessions"`
+	}
+	call(t, h, "POST", sessionsPath, admin, nil).expect(t, http.StatusOK).decode(t, &list)
+
+	if len(list.Sessions) != 3 {
+		t.Fatalf("%d sessions, want 3 including the idle one", len(list.Sessions))
+	}
+
+	var idle string
+	for _, s := range list.Sessions {
+		if s.ID == "" || s.Expiry.Before(time.Now().Add(30*time.Minute)) {
+			t.Fatalf("session %+v should last as long as its refresh token", s)
+		}
+		if rt, err := app.models.RefreshToken.GetByToken(context.Background(), idleRefresh); err == nil && rt.FamilyID == s.ID {
+			idle = s.ID
+		}
+	}
+	if idle == "" {
+		t.Fatal("the idle login is not listed")
+	}
+
+	revoke := envelope{"user_id": userID, "session_id": idle}
+	call(t, h, "POST", "/api/admin/users/sessions/revoke", admin, revoke).expect(t, http.StatusOK)
+	call(t, h, "POST", "/api/admin/users/sessions/revoke", admin, revoke).expect(t, http.StatusNotFound)
+
+	// revoking the session revoked its refresh token
+	call(t, h, "POST", "/api/token/refresh", "", envelope{"refresh_token": idleRefresh}).expect(t, http.StatusUnauthorized)
+
+	call(t, h, "POST", sessionsPath, admin, nil).expect(t, http.StatusOK).decode(t, &list)
+	if len(list.Sessions) != 2 {
+		t.Fatalf("%d sessions after revoking one, want 2", len(list.Sessions))
+	}
+}
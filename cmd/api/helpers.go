@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -93,3 +97,155 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 
 	app.writeJSON(w, statusCode, payload)
 }
+
+// clientIP returns the address of the client that sent the request. When
+// it came through one of the trusted proxies, the client is the last
+// address in X-Forwarded-For that is not itself a trusted proxy, anything
+// before it could have been made up by the client.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(host) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			// garbage was added before the proxy we trust, stop there
+			return host
+		}
+		host = forwarded[i]
+		if !app.trustedProxy(host) {
+			return host
+		}
+	}
+
+	return host
+}
+
+// trustedProxy reports whether addr is one of the configured proxies
+func (app *application) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range app.config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// background runs fn in its own goroutine, recovering and logging any panic
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.errorLog.Println(fmt.Errorf("%s", err))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// readInt reads an integer from the query string, or returns def if it is unset
+func readInt(qs url.Values, key string, def int) (int, error) {
+	value := qs.Get(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+
+	return n, nil
+}
+
+// readCSV reads a list from the query string, given either comma separated or
+// as a repeated parameter
+func readCSV(qs url.Values, key string) []string {
+	var values []string
+
+	for _, value := range qs[key] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+
+	return values
+}
+
+// paginationMetadata describes where a page sits in a listing
+type paginationMetadata struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	FirstPage    int `json:"first_page"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+}
+
+func newPaginationMetadata(page, pageSize, total int) paginationMetadata {
+	if total == 0 {
+		return paginationMetadata{CurrentPage: page, PageSize: pageSize}
+	}
+
+	return paginationMetadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     (total + pageSize - 1) / pageSize,
+		TotalRecords: total,
+	}
+}
+
+// paginationHeaders returns a Link header with the first, prev, next and last
+// pages of the listing at r, and the total number of records
+func paginationHeaders(r *http.Request, metadata paginationMetadata) http.Header {
+	pageURL := func(page int) string {
+		u := *r.URL
+		qs := u.Query()
+		qs.Set("page", strconv.Itoa(page))
+		u.RawQuery = qs.Encode()
+		return u.RequestURI()
+	}
+
+	var links []string
+	if metadata.LastPage > 0 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="first"`, pageURL(metadata.FirstPage)))
+		if metadata.CurrentPage > 1 && metadata.CurrentPage <= metadata.LastPage {
+			links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(metadata.CurrentPage-1)))
+		}
+		if metadata.CurrentPage < metadata.LastPage {
+			links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(metadata.CurrentPage+1)))
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL(metadata.LastPage)))
+	}
+
+	headers := http.Header{}
+	headers.Set("X-Total-Count", strconv.Itoa(metadata.TotalRecords))
+	if len(links) > 0 {
+		headers.Set("Link", strings.Join(links, ", "))
+	}
+
+	return headers
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		trusted    bool
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", true, "203.0.113.7:4321", nil, "203.0.113.7"},
+		{"forwarded by an untrusted client", true, "203.0.113.7:4321", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"no proxies configured", false, "10.0.0.2:80", []string{"198.51.100.1"}, "10.0.0.2"},
+		{"through a trusted proxy", true, "10.0.0.2:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries before the proxy", true, "10.0.0.2:80", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"through two trusted proxies", true, "10.0.0.2:80", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"split over headers", true, "10.0.0.2:80", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage from the proxy", true, "10.0.0.2:80", []string{"not-an-ip"}, "10.0.0.2"},
+		{"only proxies", true, "10.0.0.2:80", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"trusted proxy without header", true, "10.0.0.2:80", nil, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			if tt.trusted {
+				app.config.trustedProxies = []*net.IPNet{proxies}
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			if got := app.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,39 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"go-api/internal/data"
 	"go-api/internal/driver"
+	"go-api/internal/mailer"
+	"go-api/internal/storage"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type config struct {
-	port int
+	port            int
+	dbTimeouts      data.Timeouts
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	frontendURL     string
+	mfaIssuer       string
+	storage         string
+	trashRetention  time.Duration
+	trustedProxies  []*net.IPNet
+	s3              storage.S3Config
+	smtp            struct {
+		host     string
+		port     int
+		username string
+		password string
+		from     string
+	}
 }
 
 type application struct {
@@ -18,6 +41,8 @@ type application struct {
 	infoLog     *log.Logger
 	errorLog    *log.Logger
 	models      data.Models
+	mailer      *mailer.Mailer
+	storage     storage.Storage
 	environment string
 }
 
@@ -28,24 +53,150 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
-	dns := os.Getenv("DSN")
-	environment := os.Getenv("ENV")
+	var err error
+	cfg.dbTimeouts = data.DefaultTimeouts
+	cfg.dbTimeouts.Read, err = durationEnv("DB_READ_TIMEOUT", cfg.dbTimeouts.Read)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.dbTimeouts.Write, err = durationEnv("DB_WRITE_TIMEOUT", cfg.dbTimeouts.Write)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.accessTokenTTL, err = durationEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.refreshTokenTTL, err = durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	db, err := driver.ConnectPostgres(dns)
+	// defaults match the mailhog service in docker-compose.yml
+	cfg.frontendURL = stringEnv("FRONTEND_URL", "http://localhost:8080")
+	cfg.mfaIssuer = stringEnv("MFA_ISSUER", "Go API")
+	cfg.smtp.host = stringEnv("SMTP_HOST", "localhost")
+	cfg.smtp.port, err = strconv.Atoi(stringEnv("SMTP_PORT", "1025"))
 	if err != nil {
-		log.Fatal("Cannot connect to database")
+		log.Fatal("invalid SMTP_PORT")
 	}
+	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
+	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.smtp.from = stringEnv("MAIL_FROM", "Go API <no-reply@example.com>")
 
-	defer db.SQL.Close()
+	cfg.trashRetention, err = durationEnv("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the reverse proxies whose X-Forwarded-For is believed, such as
+	// "10.0.0.0/8,127.0.0.1", without them the client is RemoteAddr
+	cfg.trustedProxies, err = networksEnv("TRUSTED_PROXIES")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// covers are kept in ./static unless STORAGE=s3, the defaults match the
+	// minio service in docker-compose.yml
+	cfg.storage = stringEnv("STORAGE", "local")
+	cfg.s3.Endpoint = stringEnv("S3_ENDPOINT", "localhost:9000")
+	cfg.s3.Region = os.Getenv("S3_REGION")
+	cfg.s3.Bucket = stringEnv("S3_BUCKET", "go-api")
+	cfg.s3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.s3.SecretKey = os.Getenv("S3_SECRET_KEY")
+	cfg.s3.PublicURL = os.Getenv("S3_PUBLIC_URL")
+	cfg.s3.UseSSL, err = boolEnv("S3_USE_SSL", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.s3.Private, err = boolEnv("S3_PRIVATE", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.s3.URLExpiry, err = durationEnv("S3_URL_EXPIRY", time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dns := os.Getenv("DSN")
+	environment := os.Getenv("ENV")
+	store := os.Getenv("STORE")
 
 	app := &application{
 		config:      cfg,
 		infoLog:     infoLog,
 		errorLog:    errorLog,
-		models:      data.New(db.SQL),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.from),
 		environment: environment,
 	}
 
+	// migrations run before storage is set up, so they need no storage
+	// credentials
+	migrate := len(os.Args) > 1 && os.Args[1] == "migrate"
+
+	if store == "memory" {
+		if migrate {
+			infoLog.Println("the in-memory store has no migrations, nothing to do")
+			return
+		}
+
+		// everything lives in process memory, no services needed
+		app.models = data.NewMemoryDemo()
+		infoLog.Printf("using in-memory store, log in as %s / %s", data.DemoEmail, data.DemoPassword)
+	} else {
+		db, err := driver.ConnectPostgres(dns)
+		if err != nil {
+			log.Fatal("Cannot connect to database")
+		}
+
+		defer db.SQL.Close()
+
+		app.models = data.New(db.SQL, cfg.dbTimeouts)
+
+		// go run ./cmd/api migrate up|down|status
+		if migrate {
+			if err := app.migrate(db.SQL, os.Args[2:]); err != nil {
+				errorLog.Fatal(err)
+			}
+			return
+		}
+	}
+
+	switch cfg.storage {
+	case "local":
+		app.storage = storage.NewLocal(staticPath, "/static")
+	case "s3":
+		s3, err := storage.NewS3(cfg.s3)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := s3.EnsureBucket(context.Background()); err != nil {
+			log.Fatal("Cannot reach cover storage: ", err)
+		}
+		app.storage = s3
+	default:
+		log.Fatalf("unknown STORAGE %q, use local or s3", cfg.storage)
+	}
+
+	// go run ./cmd/api trash purge
+	if len(os.Args) > 1 && os.Args[1] == "trash" {
+		if len(os.Args) < 3 || os.Args[2] != "purge" {
+			errorLog.Fatal("usage: trash purge")
+		}
+		if _, _, err := app.purgeTrash(context.Background()); err != nil {
+			errorLog.Fatal(err)
+		}
+		return
+	}
+
+	// go run ./cmd/api covers backfill [-all]
+	if len(os.Args) > 1 && os.Args[1] == "covers" {
+		if err := app.backfillCovers(os.Args[2:]); err != nil {
+			errorLog.Fatal(err)
+		}
+		return
+	}
+
 	err = app.serve()
 
 	if err != nil {
@@ -56,9 +207,83 @@ func main() {
 func (app *application) serve() error {
 	app.infoLog.Println("Server listening on app", app.config.port)
 
+	app.background(app.purgeTrashPeriodically)
+
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", app.config.port),
 		Handler: app.routes(),
 	}
 	return srv.ListenAndServe()
 }
+
+// stringEnv reads a variable from the environment, or returns def if it is unset
+func stringEnv(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// boolEnv reads a boolean such as "true" from the environment, or returns def
+func boolEnv(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	return b, nil
+}
+
+// networksEnv reads a comma separated list of IP addresses and CIDR ranges
+// from the environment, a bare address is a range of one
+func networksEnv(name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s: %q is not an IP address", name, value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// durationEnv reads a duration such as "3s" from the environment, or returns def
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	return d, nil
+}
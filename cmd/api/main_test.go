@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestNetworksEnv(t *testing.T) {
+	tests := []struct {
+		value    string
+		contains []string
+		excludes []string
+		err      bool
+	}{
+		{value: "", excludes: []string{"127.0.0.1"}},
+		{value: "127.0.0.1", contains: []string{"127.0.0.1"}, excludes: []string{"127.0.0.2"}},
+		{value: "10.0.0.0/8, ::1", contains: []string{"10.1.2.3", "::1"}, excludes: []string{"11.0.0.1", "::2"}},
+		{value: "10.0.0.0/33", err: true},
+		{value: "localhost", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEST_TRUSTED_PROXIES", tt.value)
+
+			networks, err := networksEnv("TEST_TRUSTED_PROXIES")
+			if tt.err {
+				if err == nil {
+					t.Fatal("invalid value accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			app := &application{}
+			app.config.trustedProxies = networks
+			for _, ip := range tt.contains {
+				if !app.trustedProxy(ip) {
+					t.Fatalf("%s not trusted", ip)
+				}
+			}
+			for _, ip := range tt.excludes {
+				if app.trustedProxy(ip) {
+					t.Fatalf("%s trusted", ip)
+				}
+			}
+		})
+	}
+}
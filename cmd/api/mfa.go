@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"go-api/internal/data"
+	"go-api/internal/totp"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// mfaTicketTTL is how long a user has to enter their code after the password
+const mfaTicketTTL = 5 * time.Minute
+
+// recoveryCodeCount is how many recovery codes are handed out on enrollment
+const recoveryCodeCount = 10
+
+// LoginMFA finishes a login started by Login, exchanging the ticket and a
+// current TOTP code, or an unused recovery code, for a pair of tokens
+func (app *application) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Ticket       string `json:"mfa_ticket"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	invalidTicket := errors.New("login expired, please log in again")
+
+	ticket, err := app.models.MFA.GetTicket(r.Context(), requestPayload.Ticket)
+	if err != nil {
+		app.errorJSON(w, invalidTicket, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.models.User.GetUserById(r.Context(), ticket.UserID)
+	if err != nil || user.Active == 0 {
+		app.errorJSON(w, invalidTicket, http.StatusUnauthorized)
+		return
+	}
+
+	auditActor(r, 0, user.Email)
+	auditTarget(r, "user", user.ID)
+
+	ip := app.clientIP(r)
+
+	lockedUntil, locked, err := app.loginLockedUntil(r.Context(), data.EmailAttemptKey(user.Email), data.IPAttemptKey(ip))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if locked {
+		retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		app.errorJSON(w, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	valid, err := app.verifySecondFactor(r.Context(), user.ID, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		if err := app.recordLoginFailure(r.Context(), user.Email, ip); err != nil {
+			app.errorLog.Println(err)
+		}
+		app.errorJSON(w, errors.New("invalid authentication code"))
+		return
+	}
+
+	auditActor(r, user.ID, user.Email)
+
+	// a ticket is good for one login only
+	err = app.models.MFA.DeleteTicket(r.Context(), ticket.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, invalidTicket, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.models.LoginAttempt.Reset(r.Context(), data.EmailAttemptKey(user.Email)); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// verifySecondFactor checks code against the user's authenticator, or uses up
+// recoveryCode when one is given. A code is only accepted once.
+func (app *application) verifySecondFactor(ctx context.Context, userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.MFA.UseRecoveryCode(ctx, userID, recoveryCode)
+	}
+
+	t, err := app.models.MFA.GetTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !t.Enabled {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(t.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.MFA.UseStep(ctx, userID, step)
+}
+
+// EnrollMFA starts two-factor enrollment for the logged in user and returns
+// the secret and an otpauth URI to show as a QR code
+func (app *application) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	auditTarget(r, "user", user.ID)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.MFA.StartEnrollment(r.Context(), user.ID, secret)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "scan the code with your authenticator app, then confirm with a code from it",
+		Data:    envelope{"secret": secret, "uri": totp.URI(secret, app.config.mfaIssuer, user.Email)},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ConfirmMFA turns two-factor authentication on once the user proves their
+// app produces valid codes, and returns their recovery codes
+func (app *application) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	auditTarget(r, "user", user.ID)
+
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	t, err := app.models.MFA.GetTOTP(r.Context(), user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("start enrollment first"))
+		return
+	} else if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if t.Enabled {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	step, ok := totp.Validate(t.Secret, requestPayload.Code, time.Now())
+	if !ok {
+		app.errorJSON(w, errors.New("invalid authentication code"))
+		return
+	}
+
+	codes, err := data.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.MFA.Enable(r.Context(), user.ID, step, codes)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "two-factor authentication enabled, store the recovery codes somewhere safe",
+		Data:    envelope{"recovery_codes": codes},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// DisableMFA turns two-factor authentication off for the logged in user, who
+// must give a current code or a recovery code
+func (app *application) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	auditTarget(r, "user", user.ID)
+
+	var requestPayload struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	valid, err := app.verifySecondFactor(r.Context(), user.ID, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		app.errorJSON(w, errors.New("invalid authentication code"))
+		return
+	}
+
+	err = app.models.MFA.Disable(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "two-factor authentication disabled",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ResetUserMFA turns two-factor authentication off for a user who lost their
+// device and their recovery codes
+func (app *application) ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.MFA.Disable(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "two-factor authentication reset",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"go-api/internal/data"
 	"net/http"
 )
 
+type contextKey string
+
+const userContextKey = contextKey("user")
+
 func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		app.infoLog.Println("admin")
-		_, err := app.models.Token.AuthenticateToken(r)
+		user, err := app.models.Token.AuthenticateToken(r)
+		if errors.Is(err, data.ErrTokenExpired) {
+			// tells clients holding a refresh token to use it and retry
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="access token expired"`)
+			payload := jsonResponse{
+				Error:   true,
+				Message: "access token expired",
+			}
+			_ = app.writeJSON(w, http.StatusUnauthorized, payload)
+			return
+		}
 		if err != nil {
 			payload := jsonResponse{
 				Error:   true,
@@ -16,6 +33,37 @@ func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 			_ = app.writeJSON(w, http.StatusUnauthorized, payload)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = data.WithEditor(ctx, user.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// authenticatedUser returns the user AuthTokenMiddleware stored on the request
+func (app *application) authenticatedUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// requirePermission only lets through users whose role grants permission, it
+// must run after AuthTokenMiddleware
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authenticatedUser(r)
+			if user == nil || !user.Can(permission) {
+				payload := jsonResponse{
+					Error:   true,
+					Message: "you do not have permission to do that",
+				}
+				_ = app.writeJSON(w, http.StatusForbidden, payload)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"go-api/internal/data"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// BookRevisions lists every revision of a book, newest first
+func (app *application) BookRevisions(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	revisions, err := app.models.Book.Revisions(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if len(revisions) == 0 {
+		app.errorJSON(w, errors.New("book not found"), http.StatusNotFound)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"revisions": revisions},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// DiffBookRevisions lists the fields that changed between two revisions of a
+// book. Without a to revision the book is compared as it is now.
+func (app *application) DiffBookRevisions(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.To == 0 {
+		revisions, err := app.models.Book.Revisions(r.Context(), bookID)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		if len(revisions) > 0 {
+			requestPayload.To = revisions[0].Revision
+		}
+	}
+
+	from, err := app.models.Book.Revision(r.Context(), bookID, requestPayload.From)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("revision not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	to, err := app.models.Book.Revision(r.Context(), bookID, requestPayload.To)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("revision not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	changes, err := data.DiffSnapshots(from.Snapshot, to.Snapshot)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"from": from.Revision, "to": to.Revision, "changes": changes},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RevertBook puts a book back the way it was at an earlier revision, keeping
+// its current cover. The revert is itself recorded as a new revision, and
+// like any other save it must say which version of the book it was made
+// from.
+func (app *application) RevertBook(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Revision int `json:"revision"`
+		Version  int `json:"version"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	version, ifMatch, err := expectedVersion(r, requestPayload.Version)
+	if err != nil {
+		app.versionError(w, err)
+		return
+	}
+
+	var before envelope
+	if current, err := app.models.Book.GetOneById(r.Context(), bookID); err == nil {
+		before = bookSummary(current)
+	}
+
+	err = app.models.Book.Revert(r.Context(), bookID, requestPayload.Revision, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("book or revision not found"), http.StatusNotFound)
+		return
+	} else if errors.Is(err, data.ErrEditConflict) {
+		app.bookConflict(w, r, ifMatch, bookID)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	book, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	after := bookSummary(book)
+	after["reverted_to"] = requestPayload.Revision
+	app.auditChange(r, before, after)
+
+	if err := app.resolveCovers(r.Context(), book); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Book Reverted",
+		Data:    envelope{"book": book, "version": book.Version},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload, versionHeader(book.Version))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"go-api/internal/data"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -10,20 +11,29 @@ import (
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
+	mux.Use(middleware.RequestID)
 	mux.Use(middleware.Recoverer)
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT", "PATCH"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "X-Request-Id"},
+		ExposedHeaders:   []string{"Link", "X-Total-Count", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/login", app.Login)
-	mux.Post("/api/logout", app.Logout)
+	mux.With(app.audit("user.login")).Post("/api/login", app.Login)
+	mux.With(app.audit("user.login_mfa")).Post("/api/login/mfa", app.LoginMFA)
+	mux.With(app.audit("user.logout")).Post("/api/logout", app.Logout)
+	mux.With(app.audit("user.token_refresh")).Post("/api/token/refresh", app.RefreshToken)
+	mux.With(app.audit("user.password_forgot")).Post("/api/forgot-password", app.ForgotPassword)
+	mux.With(app.audit("user.password_reset")).Post("/api/reset-password", app.ResetPassword)
 	mux.Get("/api/books", app.AllBooks)
+	mux.Get("/api/books/search", app.SearchBooks)
 	mux.Get("/api/books/{slug}", app.OneBook)
+	mux.Get("/api/authors/{slug}", app.OneAuthor)
+	mux.Get("/api/genres", app.AllGenres)
+	mux.Get("/api/genres/{slug}/books", app.GenreBooks)
 
 	mux.Post("/api/validate-token", app.ValidateToken)
 
@@ -31,21 +41,61 @@ func (app *application) routes() http.Handler {
 		// AUTHENTICATED ROUTES
 		mux.Use(app.AuthTokenMiddleware)
 
+		// audit comes after requirePermission, so a request turned away is not
+		// logged as though the action ran
+
 		// Users
-		mux.Post("/users", app.AllUsers)
-		mux.Post("/users/save", app.EditUser)
-		mux.Post("/users/get/{id}", app.GetUser)
-		mux.Post("/users/delete", app.DeleteUser)
-		mux.Post("/users/user-logout/{id}", app.LogUserOutAndSetInactive)
+		mux.With(app.requirePermission(data.PermUsersRead)).Post("/users", app.AllUsers)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.save")).Post("/users/save", app.EditUser)
+		mux.With(app.requirePermission(data.PermUsersRead)).Post("/users/get/{id}", app.GetUser)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.delete")).Post("/users/delete", app.DeleteUser)
+		mux.With(app.requirePermission(data.PermUsersRead)).Post("/users/trash", app.TrashedUsers)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.restore")).Post("/users/restore", app.RestoreUser)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.deactivate")).Post("/users/user-logout/{id}", app.LogUserOutAndSetInactive)
+		mux.With(app.requirePermission(data.PermUsersRead)).Post("/users/sessions/{id}", app.UserSessions)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("session.revoke")).Post("/users/sessions/revoke", app.RevokeSession)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.revoke_sessions")).Post("/users/sessions/revoke-all/{id}", app.RevokeAllSessions)
+
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("user.mfa_reset")).Post("/users/mfa-reset/{id}", app.ResetUserMFA)
+
+		// Two-factor authentication for the logged in user
+		mux.With(app.audit("user.mfa_enroll")).Post("/mfa/enroll", app.EnrollMFA)
+		mux.With(app.audit("user.mfa_confirm")).Post("/mfa/confirm", app.ConfirmMFA)
+		mux.With(app.audit("user.mfa_disable")).Post("/mfa/disable", app.DisableMFA)
+
+		// Login lockouts
+		mux.With(app.requirePermission(data.PermUsersRead)).Post("/lockouts", app.LockedLogins)
+		mux.With(app.requirePermission(data.PermUsersWrite), app.audit("lockout.unlock")).Post("/lockouts/unlock", app.UnlockLogin)
 
 		// Authors
-		mux.Post("/authors", app.AllAuthors)
+		mux.With(app.requirePermission(data.PermAuthorsRead)).Post("/authors", app.AllAuthors)
+		mux.With(app.requirePermission(data.PermAuthorsRead)).Post("/authors/get/{id}", app.AuthorById)
+		mux.With(app.requirePermission(data.PermAuthorsWrite), app.audit("author.save")).Post("/authors/save", app.EditAuthor)
+		mux.With(app.requirePermission(data.PermAuthorsWrite), app.audit("author.delete")).Post("/authors/delete", app.AuthorDelete)
+
+		// Genres
+		mux.With(app.requirePermission(data.PermGenresRead)).Post("/genres", app.AllGenres)
+		mux.With(app.requirePermission(data.PermGenresWrite), app.audit("genre.save")).Post("/genres/save", app.EditGenre)
+		mux.With(app.requirePermission(data.PermGenresWrite), app.audit("genre.delete")).Post("/genres/delete", app.GenreDelete)
+		mux.With(app.requirePermission(data.PermGenresWrite), app.audit("genre.merge")).Post("/genres/merge", app.GenreMerge)
 
 		// Books
-		mux.Post("/books/{id}", app.BookById)
-		mux.Post("/books/delete", app.BookDelete)
-		mux.Post("/books/save", app.EditBook)
+		mux.With(app.requirePermission(data.PermBooksRead)).Post("/books/{id}", app.BookById)
+		mux.With(app.requirePermission(data.PermBooksWrite), app.audit("book.delete")).Post("/books/delete", app.BookDelete)
+		mux.With(app.requirePermission(data.PermBooksRead)).Post("/books/trash", app.TrashedBooks)
+		mux.With(app.requirePermission(data.PermBooksWrite), app.audit("book.restore")).Post("/books/restore", app.RestoreBook)
+		mux.With(app.requirePermission(data.PermBooksWrite), app.audit("book.save")).Post("/books/save", app.EditBook)
+		mux.With(app.requirePermission(data.PermBooksWrite), app.audit("book.cover")).Post("/books/cover/{id}", app.UploadCover)
+		mux.With(app.requirePermission(data.PermBooksRead)).Post("/books/revisions/{id}", app.BookRevisions)
+		mux.With(app.requirePermission(data.PermBooksRead)).Post("/books/revisions/{id}/diff", app.DiffBookRevisions)
+		mux.With(app.requirePermission(data.PermBooksWrite), app.audit("book.revert")).Post("/books/revisions/{id}/revert", app.RevertBook)
+
+		// Trash
+		mux.With(app.requirePermission(data.PermTrashPurge), app.audit("trash.purge")).Post("/trash/purge", app.PurgeTrash)
 
+		// Audit log
+		mux.With(app.requirePermission(data.PermAuditRead)).Post("/audit", app.AuditLog)
+		mux.With(app.requirePermission(data.PermAuditRead)).Post("/audit/export", app.ExportAuditLog)
 	})
 
 	//static
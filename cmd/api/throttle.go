@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"go-api/internal/data"
+	"math"
+	"time"
+)
+
+// login throttling policy: each email and each client IP gets a number of free
+// failed attempts, after which every further failure locks it out for twice as
+// long as the previous one, up to loginLockoutMax
+const (
+	loginAttemptWindow = time.Hour
+	emailFreeAttempts  = 5
+	ipFreeAttempts     = 20
+	loginLockoutBase   = time.Minute
+	loginLockoutMax    = time.Hour
+)
+
+// lockoutFor returns how long to lock a key out after failures
+func lockoutFor(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+
+	lockout := float64(loginLockoutBase) * math.Pow(2, float64(failures-free))
+	if lockout > float64(loginLockoutMax) {
+		return loginLockoutMax
+	}
+
+	return time.Duration(lockout)
+}
+
+// loginLockedUntil returns the latest time any of keys is locked out until
+func (app *application) loginLockedUntil(ctx context.Context, keys ...string) (time.Time, bool, error) {
+	var until time.Time
+	locked := false
+
+	for _, key := range keys {
+		attempt, err := app.models.LoginAttempt.Get(ctx, key)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		if attempt.Locked(time.Now()) && attempt.LockedUntil.After(until) {
+			until = *attempt.LockedUntil
+			locked = true
+		}
+	}
+
+	return until, locked, nil
+}
+
+// recordLoginFailure counts a failed login against the email and the client
+// IP, locking out whichever has used up its free attempts
+func (app *application) recordLoginFailure(ctx context.Context, email, ip string) error {
+	for _, k := range []struct {
+		key  string
+		free int
+	}{
+		{data.EmailAttemptKey(email), emailFreeAttempts},
+		{data.IPAttemptKey(ip), ipFreeAttempts},
+	} {
+		failures, err := app.models.LoginAttempt.RecordFailure(ctx, k.key, loginAttemptWindow)
+		if err != nil {
+			return err
+		}
+
+		if lockout := lockoutFor(failures, k.free); lockout > 0 {
+			if err := app.models.LoginAttempt.Lock(ctx, k.key, time.Now().Add(lockout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
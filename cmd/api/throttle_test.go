@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"go-api/internal/data"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLockoutFor(t *testing.T) {
+	tests := []struct {
+		failures int
+		free     int
+		want     time.Duration
+	}{
+		{0, 5, 0},
+		{4, 5, 0},
+		{5, 5, time.Minute},
+		{6, 5, 2 * time.Minute},
+		{10, 5, 32 * time.Minute},
+		{11, 5, loginLockoutMax},
+		{100, 5, loginLockoutMax},
+		{19, 20, 0},
+		{20, 20, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutFor(tt.failures, tt.free); got != tt.want {
+			t.Fatalf("lockoutFor(%d, %d) = %s, want %s", tt.failures, tt.free, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	app, h := newTestApp(t)
+
+	// requests arrive through a proxy at the address httptest uses
+	_, proxy, err := net.ParseCIDR("192.0.2.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.trustedProxies = []*net.IPNet{proxy}
+
+	attempt := func(email, password, client string) testResponse {
+		t.Helper()
+		return call(t, h, "POST", "/api/login", "", envelope{"email": email, "password": password}, "X-Forwarded-For", client)
+	}
+
+	// an email is locked out after its free attempts, whatever the address
+	for i := 0; i < emailFreeAttempts; i++ {
+		attempt(data.DemoEmail, "wrong-password", fmt.Sprintf("198.51.100.%d", i)).expect(t, http.StatusBadRequest)
+	}
+	res := attempt(data.DemoEmail, data.DemoPassword, "198.51.100.200").expect(t, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatal("lockout has no Retry-After")
+	}
+
+	// a client guessing at many emails is locked out by its address
+	for i := 0; i < ipFreeAttempts; i++ {
+		attempt(fmt.Sprintf("nobody%d@example.com", i), "password", "203.0.113.9").expect(t, http.StatusBadRequest)
+	}
+	attempt("someone@example.com", "password", "203.0.113.9").expect(t, http.StatusTooManyRequests)
+
+	// other clients behind the same proxy are not
+	attempt("someone@example.com", "password", "203.0.113.10").expect(t, http.StatusBadRequest)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// trashPurgeInterval is how often items past the retention period are purged
+const trashPurgeInterval = time.Hour
+
+// TrashedBooks lists the books in the trash
+func (app *application) TrashedBooks(w http.ResponseWriter, r *http.Request) {
+	books, err := app.models.Book.Trashed(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if err := app.resolveCovers(r.Context(), books...); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"books": books, "retention": app.config.trashRetention.String()},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RestoreBook takes a book back out of the trash
+func (app *application) RestoreBook(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID int `json:"id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "book", requestPayload.ID)
+
+	var before envelope
+	if trashed, err := app.models.Book.Trashed(r.Context()); err == nil {
+		for _, book := range trashed {
+			if book.ID == requestPayload.ID {
+				before = bookSummary(book)
+				before["deleted_at"] = book.DeletedAt
+			}
+		}
+	}
+
+	err := app.models.Book.Restore(r.Context(), requestPayload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("book not found in the trash"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if book, err := app.models.Book.GetOneById(r.Context(), requestPayload.ID); err == nil {
+		app.auditChange(r, before, bookSummary(book))
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Book Restored",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// TrashedUsers lists the users in the trash
+func (app *application) TrashedUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.models.User.TrashedUsers(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"users": users, "retention": app.config.trashRetention.String()},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RestoreUser takes a user back out of the trash
+func (app *application) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ID int `json:"id"`
+	}
+
+	if err := app.readJSON(w, r, &requestPayload); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	auditTarget(r, "user", requestPayload.ID)
+
+	var before envelope
+	if trashed, err := app.models.User.TrashedUsers(r.Context()); err == nil {
+		for _, user := range trashed {
+			if user.ID == requestPayload.ID {
+				before = userSummary(user)
+				before["deleted_at"] = user.DeletedAt
+			}
+		}
+	}
+
+	// the user's email may have been registered again while they were in the
+	// trash, the unique index on live users turns the restore away then
+	err := app.models.User.RestoreUser(r.Context(), requestPayload.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found in the trash"), http.StatusNotFound)
+		return
+	} else if err != nil && strings.Contains(err.Error(), "SQLSTATE 23505") {
+		app.errorJSON(w, errors.New("another user has registered this user's email since they were deleted"), http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if user, err := app.models.User.GetUserById(r.Context(), requestPayload.ID); err == nil {
+		app.auditChange(r, before, userSummary(user))
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "User Restored",
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// PurgeTrash deletes for good everything that has been in the trash longer
+// than the retention period, without waiting for the hourly purge
+func (app *application) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	books, users, err := app.purgeTrash(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.auditChange(r, nil, envelope{"books": books, "users": users})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Trash Purged",
+		Data:    envelope{"books": books, "users": users},
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// purgeTrash deletes the books and users that went into the trash more than
+// the retention period ago, along with the cover files of those books
+func (app *application) purgeTrash(ctx context.Context) (int, int, error) {
+	cutoff := time.Now().Add(-app.config.trashRetention)
+
+	books, err := app.models.Book.Purge(ctx, cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, book := range books {
+		app.removeCover(ctx, book.Cover, book.Covers)
+	}
+
+	users, err := app.models.User.PurgeUsers(ctx, cutoff)
+	if err != nil {
+		return len(books), 0, err
+	}
+
+	if len(books) > 0 || users > 0 {
+		app.infoLog.Printf("purged %d books and %d users from the trash", len(books), users)
+	}
+
+	return len(books), users, nil
+}
+
+// purgeTrashPeriodically runs purgeTrash every trashPurgeInterval, it never
+// returns
+func (app *application) purgeTrashPeriodically() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, _, err := app.purgeTrash(context.Background()); err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
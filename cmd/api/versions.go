@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errVersionRequired is returned for a save that does not say which version
+// of the record it was made from
+var errVersionRequired = errors.New("the version being edited is required, send it in the If-Match header or the version field")
+
+// versionHeader returns the ETag header for a record at version
+func versionHeader(version int) http.Header {
+	h := http.Header{}
+	h.Set("ETag", strconv.Quote(strconv.Itoa(version)))
+	return h
+}
+
+// expectedVersion returns the version of a record a save was made from. The
+// If-Match header is used when it is sent, otherwise payloadVersion, and
+// ifMatch reports which it was.
+func expectedVersion(r *http.Request, payloadVersion int) (version int, ifMatch bool, err error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if payloadVersion < 1 {
+			return 0, false, errVersionRequired
+		}
+		return payloadVersion, false, nil
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err = strconv.Atoi(tag)
+	if err != nil || version < 1 {
+		return 0, true, fmt.Errorf("If-Match must be the ETag of the record being edited, not %s", header)
+	}
+
+	return version, true, nil
+}
+
+// editConflict answers a save made from a stale version with the record as
+// it is now, 412 when the version came from If-Match and 409 when it came
+// from the payload
+func (app *application) editConflict(w http.ResponseWriter, ifMatch bool, name string, current interface{}, version int) {
+	status := http.StatusConflict
+	if ifMatch {
+		status = http.StatusPreconditionFailed
+	}
+
+	payload := jsonResponse{
+		Error:   true,
+		Message: fmt.Sprintf("the %s was changed by someone else since it was read, review the current version and save again", name),
+		Data:    envelope{name: current, "version": version},
+	}
+
+	app.writeJSON(w, status, payload, versionHeader(version))
+}
+
+// versionError answers a save whose version is missing or malformed
+func (app *application) versionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errVersionRequired) {
+		app.errorJSON(w, err, http.StatusPreconditionRequired)
+		return
+	}
+	app.errorJSON(w, err)
+}
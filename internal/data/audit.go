@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one administrative action or login. ActorID is nil
+// when nobody is logged in, such as for a failed login, and Before and After
+// summarize the target around the change when the action knows them.
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	ActorID    *int            `json:"actor_id"`
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Status     int             `json:"status"`
+	IPAddress  string          `json:"ip_address"`
+	RequestID  string          `json:"request_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditFilter narrows a listing of the audit log. Zero values leave a filter
+// off, Page and PageSize are ignored by Export.
+type AuditFilter struct {
+	Page       int
+	PageSize   int
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+}
+
+// Validate reports the first problem with the filter, if any
+func (f AuditFilter) Validate() error {
+	if f.Page < 1 {
+		return fmt.Errorf("page must be at least 1")
+	}
+
+	if f.PageSize < 1 || f.PageSize > MaxPageSize {
+		return fmt.Errorf("page_size must be between 1 and %d", MaxPageSize)
+	}
+
+	if !f.From.IsZero() && !f.To.IsZero() && f.From.After(f.To) {
+		return fmt.Errorf("from must not be after to")
+	}
+
+	return nil
+}
+
+// matches reports whether entry passes the filter, the way where selects it
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	switch {
+	case f.ActorID != 0 && (entry.ActorID == nil || *entry.ActorID != f.ActorID):
+		return false
+	case f.Action != "" && entry.Action != f.Action:
+		return false
+	case f.TargetType != "" && entry.TargetType != f.TargetType:
+		return false
+	case f.TargetID != "" && entry.TargetID != f.TargetID:
+		return false
+	case !f.From.IsZero() && entry.CreatedAt.Before(f.From):
+		return false
+	case !f.To.IsZero() && !entry.CreatedAt.Before(f.To):
+		return false
+	}
+
+	return true
+}
+
+// where returns the conditions and arguments for the filter's where clause
+func (f AuditFilter) where() (string, []interface{}) {
+	conditions := []string{"true"}
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+
+	return "where " + strings.Join(conditions, " and "), args
+}
+
+type postgresAuditStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+const auditColumns = `id, actor_id, actor_email, action, target_type, target_id, before, after, status,
+	ip_address, request_id, created_at`
+
+func scanAuditEntry(row rowScanner) (*AuditEntry, error) {
+	var entry AuditEntry
+	var before, after []byte
+
+	err := row.Scan(
+		&entry.ID,
+		&entry.ActorID,
+		&entry.ActorEmail,
+		&entry.Action,
+		&entry.TargetType,
+		&entry.TargetID,
+		&before,
+		&after,
+		&entry.Status,
+		&entry.IPAddress,
+		&entry.RequestID,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if before != nil {
+		entry.Before = json.RawMessage(before)
+	}
+	if after != nil {
+		entry.After = json.RawMessage(after)
+	}
+
+	return &entry, nil
+}
+
+// rawJSON returns a json column value, nil for sql null
+func rawJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// Record appends an entry to the audit log
+func (s *postgresAuditStore) Record(ctx context.Context, entry AuditEntry) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `insert into audit_log (actor_id, actor_email, action, target_type, target_id, before, after, status,
+		ip_address, request_id, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	_, err := s.db.ExecContext(ctx, stmt,
+		entry.ActorID,
+		entry.ActorEmail,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		rawJSON(entry.Before),
+		rawJSON(entry.After),
+		entry.Status,
+		entry.IPAddress,
+		entry.RequestID,
+		time.Now(),
+	)
+
+	return err
+}
+
+// List returns one page of the entries matching f, newest first, along with
+// how many entries match in total
+func (s *postgresAuditStore) List(ctx context.Context, f AuditFilter) ([]*AuditEntry, int, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	where, args := f.where()
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from audit_log `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`select `+auditColumns+` from audit_log %s order by id desc limit $%d offset $%d`,
+		where, len(args)+1, len(args)+2)
+	args = append(args, f.PageSize, (f.Page-1)*f.PageSize)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, total, rows.Err()
+}
+
+// Export calls fn with every entry matching f, oldest first, stopping at the
+// first error fn returns. It is not bound by the read timeout since the log
+// may be long, the caller's context still cancels it.
+func (s *postgresAuditStore) Export(ctx context.Context, f AuditFilter, fn func(*AuditEntry) error) error {
+	where, args := f.where()
+
+	rows, err := s.db.QueryContext(ctx, `select `+auditColumns+` from audit_log `+where+` order by id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
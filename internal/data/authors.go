@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrAuthorHasBooks is returned when deleting an author still credited on
+// some books
+var ErrAuthorHasBooks = errors.New("author still has books")
+
+// authorColumns are the columns scanAuthor reads
+const authorColumns = `id, author_name, slug, bio, photo, photos, created_at, updated_at`
+
+func scanAuthor(row rowScanner) (*Author, error) {
+	var author Author
+
+	err := row.Scan(
+		&author.ID,
+		&author.AuthorName,
+		&author.Slug,
+		&author.Bio,
+		&author.Photo,
+		&author.Photos,
+		&author.CreatedAt,
+		&author.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &author, nil
+}
+
+// All returns a list of all authors
+func (s *postgresAuthorStore) All(ctx context.Context) ([]*Author, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + authorColumns + ` from authors order by author_name`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var authors []*Author
+
+	for rows.Next() {
+		author, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, nil
+}
+
+// GetOneById returns one author by id
+func (s *postgresAuthorStore) GetOneById(ctx context.Context, id int) (*Author, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + authorColumns + ` from authors where id = $1`
+
+	return scanAuthor(s.db.QueryRowContext(ctx, query, id))
+}
+
+// GetOneBySlug returns one author by slug
+func (s *postgresAuthorStore) GetOneBySlug(ctx context.Context, slug string) (*Author, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + authorColumns + ` from authors where slug = $1`
+
+	return scanAuthor(s.db.QueryRowContext(ctx, query, slug))
+}
+
+// NextID reserves an id for an author about to be inserted, so files named
+// after it can be stored before the author is
+func (s *postgresAuthorStore) NextID(ctx context.Context) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	var id int
+	err := s.db.QueryRowContext(ctx, `select nextval(pg_get_serial_sequence('authors', 'id'))`).Scan(&id)
+	return id, err
+}
+
+// Insert saves a new author, its slug is made from the name and numbered
+// when another author has it. The author gets a new id unless one was
+// reserved with NextID.
+func (s *postgresAuthorStore) Insert(ctx context.Context, author Author) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	slug, err := rowSlug(ctx, tx, "authors", author.AuthorName, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `insert into authors (id, author_name, slug, bio, photo, photos, created_at, updated_at)
+			values (coalesce(nullif($1::int, 0), nextval(pg_get_serial_sequence('authors', 'id'))), $2, $3, $4, $5, $6, $7, $8)
+			returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, stmt,
+		author.ID,
+		author.AuthorName,
+		slug,
+		author.Bio,
+		author.Photo,
+		author.Photos,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// Update renames an author and replaces their bio, and their photo when
+// Photo is set
+func (s *postgresAuthorStore) Update(ctx context.Context, author Author) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	slug, err := rowSlug(ctx, tx, "authors", author.AuthorName, author.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update authors set
+		author_name = $1,
+		slug = $2,
+		bio = $3,
+		photo = case when $4::varchar = '' then photo else $4 end,
+		photos = case when $4::varchar = '' then photos else $5 end,
+		updated_at = $6
+		where id = $7`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		author.AuthorName,
+		slug,
+		author.Bio,
+		author.Photo,
+		author.Photos,
+		time.Now(),
+		author.ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// SetPhoto records the file name of an author's photo and its resized copies
+func (s *postgresAuthorStore) SetPhoto(ctx context.Context, id int, photo string, photos CoverSet) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `update authors set photo = $1, photos = $2, updated_at = $3 where id = $4`
+
+	result, err := s.db.ExecContext(ctx, stmt, photo, photos, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteByID deletes an author, as long as none of their books are left
+func (s *postgresAuthorStore) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the author so no book can be added to them before the delete
+	var lockedID int
+	err = tx.QueryRowContext(ctx, `select id from authors where id = $1 for update`, id).Scan(&lockedID)
+	if err != nil {
+		return err
+	}
+
+	var books int
+	err = tx.QueryRowContext(ctx, `select count(*) from book_contributors where author_id = $1`, id).Scan(&books)
+	if err != nil {
+		return err
+	}
+
+	if books > 0 {
+		return ErrAuthorHasBooks
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from authors where id = $1`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
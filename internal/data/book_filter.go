@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MaxPageSize is the largest page of books a listing returns
+const MaxPageSize = 100
+
+// BookFilter narrows and orders a listing of books. Zero values leave a
+// filter off.
+type BookFilter struct {
+	Page     int
+	PageSize int
+	GenreIDs []int
+	// AuthorID matches every book the author contributed to
+	AuthorID   int
+	YearMin    int
+	YearMax    int
+	SlugPrefix string
+	// Sort holds keys from BookSortKeys, a leading "-" sorts descending
+	Sort []string
+}
+
+// BookSortKeys maps the sort keys a listing accepts to their columns
+var BookSortKeys = map[string]string{
+	"id":               "b.id",
+	"title":            "b.title",
+	"author":           "a.author_name",
+	"publication_year": "b.publication_year",
+	"created_at":       "b.created_at",
+	"updated_at":       "b.updated_at",
+}
+
+// Validate reports the first problem with the filter, if any
+func (f BookFilter) Validate() error {
+	if f.Page < 1 {
+		return fmt.Errorf("page must be at least 1")
+	}
+
+	if f.PageSize < 1 || f.PageSize > MaxPageSize {
+		return fmt.Errorf("page_size must be between 1 and %d", MaxPageSize)
+	}
+
+	if f.YearMin != 0 && f.YearMax != 0 && f.YearMin > f.YearMax {
+		return fmt.Errorf("year_min must not be after year_max")
+	}
+
+	for _, key := range f.Sort {
+		if _, ok := BookSortKeys[strings.TrimPrefix(key, "-")]; !ok {
+			return fmt.Errorf("unknown sort key %q", key)
+		}
+	}
+
+	return nil
+}
+
+// where returns the conditions and arguments for the filter's where clause
+func (f BookFilter) where() (string, []interface{}) {
+	// books in the trash are never listed
+	conditions := []string{"b.deleted_at is null"}
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if len(f.GenreIDs) > 0 {
+		add("b.id in (select book_id from books_genres where genre_id = any($%d))", f.GenreIDs)
+	}
+	if f.AuthorID != 0 {
+		add("b.id in (select book_id from book_contributors where author_id = $%d)", f.AuthorID)
+	}
+	if f.YearMin != 0 {
+		add("b.publication_year >= $%d", f.YearMin)
+	}
+	if f.YearMax != 0 {
+		add("b.publication_year <= $%d", f.YearMax)
+	}
+	if f.SlugPrefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.SlugPrefix)
+		add("b.slug like $%d", escaped+"%")
+	}
+
+	return "where " + strings.Join(conditions, " and "), args
+}
+
+// orderBy returns the filter's order by clause, ties are broken by id so
+// pages never overlap
+func (f BookFilter) orderBy() string {
+	var columns []string
+
+	for _, key := range f.Sort {
+		direction := "asc"
+		if strings.HasPrefix(key, "-") {
+			direction = "desc"
+		}
+		columns = append(columns, BookSortKeys[strings.TrimPrefix(key, "-")]+" "+direction)
+	}
+
+	if len(f.Sort) == 0 {
+		columns = append(columns, "b.title asc")
+	}
+
+	return "order by " + strings.Join(append(columns, "b.id asc"), ", ")
+}
+
+// GetAllFiltered returns one page of the books matching f, along with how
+// many books match in total
+func (s *postgresBookStore) GetAllFiltered(ctx context.Context, f BookFilter) ([]*Book, int, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	where, args := f.where()
+
+	var total int
+
+	countQuery := `select count(*) from books b ` + where
+	err := s.db.QueryRowContext(ctx, countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`select `+bookColumns+`
+			from books b
+			left join authors a on (b.author_id = a.id)
+			%s
+			%s
+			limit $%d offset $%d`, where, f.orderBy(), len(args)+1, len(args)+2)
+
+	args = append(args, f.PageSize, (f.Page-1)*f.PageSize)
+
+	books, err := s.queryBooks(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return books, total, nil
+}
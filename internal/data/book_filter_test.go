@@ -0,0 +1,124 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBookFilterValidate(t *testing.T) {
+	valid := BookFilter{Page: 1, PageSize: 20}
+
+	tests := []struct {
+		name    string
+		modify  func(f *BookFilter)
+		wantErr string
+	}{
+		{"defaults", func(f *BookFilter) {}, ""},
+		{"page zero", func(f *BookFilter) { f.Page = 0 }, "page must be at least 1"},
+		{"negative page", func(f *BookFilter) { f.Page = -1 }, "page must be at least 1"},
+		{"page size zero", func(f *BookFilter) { f.PageSize = 0 }, "page_size must be between 1 and 100"},
+		{"largest page size", func(f *BookFilter) { f.PageSize = MaxPageSize }, ""},
+		{"page size too large", func(f *BookFilter) { f.PageSize = MaxPageSize + 1 }, "page_size must be between 1 and 100"},
+		{"year range", func(f *BookFilter) { f.YearMin, f.YearMax = 1970, 1980 }, ""},
+		{"single year", func(f *BookFilter) { f.YearMin, f.YearMax = 1975, 1975 }, ""},
+		{"open year range", func(f *BookFilter) { f.YearMin = 1980 }, ""},
+		{"backwards year range", func(f *BookFilter) { f.YearMin, f.YearMax = 1980, 1970 }, "year_min must not be after year_max"},
+		{"sort keys", func(f *BookFilter) { f.Sort = []string{"-publication_year", "title"} }, ""},
+		{"unknown sort key", func(f *BookFilter) { f.Sort = []string{"title", "price"} }, `unknown sort key "price"`},
+		{"column name", func(f *BookFilter) { f.Sort = []string{"b.title"} }, `unknown sort key "b.title"`},
+		{"injection", func(f *BookFilter) { f.Sort = []string{"title; drop table books"} }, `unknown sort key "title; drop table books"`},
+		{"double minus", func(f *BookFilter) { f.Sort = []string{"--title"} }, `unknown sort key "--title"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := valid
+			tt.modify(&f)
+
+			err := f.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBookFilterOrderBy(t *testing.T) {
+	tests := []struct {
+		sort []string
+		want string
+	}{
+		{nil, "order by b.title asc, b.id asc"},
+		{[]string{"title"}, "order by b.title asc, b.id asc"},
+		{[]string{"-publication_year"}, "order by b.publication_year desc, b.id asc"},
+		{[]string{"author", "-created_at"}, "order by a.author_name asc, b.created_at desc, b.id asc"},
+		{[]string{"-id"}, "order by b.id desc, b.id asc"},
+	}
+
+	for _, tt := range tests {
+		f := BookFilter{Page: 1, PageSize: 20, Sort: tt.sort}
+		if err := f.Validate(); err != nil {
+			t.Fatalf("sort %v: %v", tt.sort, err)
+		}
+		if got := f.orderBy(); got != tt.want {
+			t.Fatalf("sort %v: orderBy = %q, want %q", tt.sort, got, tt.want)
+		}
+	}
+
+	// every key the filter accepts orders by one of its own columns, so
+	// nothing from the request reaches the query
+	for key, column := range BookSortKeys {
+		f := BookFilter{Sort: []string{"-" + key}}
+		if want := "order by " + column + " desc, b.id asc"; f.orderBy() != want {
+			t.Fatalf("sort -%s: orderBy = %q, want %q", key, f.orderBy(), want)
+		}
+		if !strings.HasPrefix(column, "a.") && !strings.HasPrefix(column, "b.") {
+			t.Fatalf("sort key %s orders by %q, not a books or authors column", key, column)
+		}
+	}
+}
+
+func TestBookFilterWhere(t *testing.T) {
+	tests := []struct {
+		name  string
+		f     BookFilter
+		where string
+		args  []interface{}
+	}{
+		{"no filters", BookFilter{}, "where b.deleted_at is null", nil},
+		{
+			"years",
+			BookFilter{YearMin: 1970, YearMax: 1980},
+			"where b.deleted_at is null and b.publication_year >= $1 and b.publication_year <= $2",
+			[]interface{}{1970, 1980},
+		},
+		{
+			"genres and author",
+			BookFilter{GenreIDs: []int{1, 2}, AuthorID: 3},
+			"where b.deleted_at is null and b.id in (select book_id from books_genres where genre_id = any($1)) and b.id in (select book_id from book_contributors where author_id = $2)",
+			[]interface{}{[]int{1, 2}, 3},
+		},
+		{
+			"slug prefix wildcards",
+			BookFilter{SlugPrefix: `50%_off\`},
+			"where b.deleted_at is null and b.slug like $1",
+			[]interface{}{`50\%\_off\\%`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.f.where()
+			if where != tt.where {
+				t.Fatalf("where = %q, want %q", where, tt.where)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Fatalf("args = %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
@@ -3,31 +3,44 @@ package data
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"time"
-
-	"github.com/mozillazg/go-slugify"
 )
 
-// Book is the definition of a single book
+// Book is the definition of a single book. Contributors credits everyone who
+// worked on it, the primary author in AuthorID always comes first. CoverURL
+// is filled in by the API from the storage backend, it is never stored.
+// DeletedAt is only set on books in the trash.
 type Book struct {
-	ID              int       `json:"id"`
-	Title           string    `json:"title"`
-	AuthorID        int       `json:"author_id"`
-	PublicationYear int       `json:"publication_year"`
-	Slug            string    `json:"slug"`
-	Author          Author    `json:"author"`
-	Description     string    `json:"description"`
-	Genres          []Genre   `json:"genres"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
-	GenreIDs        []int     `json:"genre_ids,omitempty"`
+	ID              int           `json:"id"`
+	Title           string        `json:"title"`
+	AuthorID        int           `json:"author_id"`
+	PublicationYear int           `json:"publication_year"`
+	Slug            string        `json:"slug"`
+	Author          Author        `json:"author"`
+	Description     string        `json:"description"`
+	Cover           string        `json:"cover"`
+	CoverURL        string        `json:"cover_url,omitempty"`
+	Covers          CoverSet      `json:"covers"`
+	Genres          []Genre       `json:"genres"`
+	Contributors    []Contributor `json:"contributors"`
+	CreatedAt       time.Time     `json:"created_at"`
+	UpdatedAt       time.Time     `json:"updated_at"`
+	DeletedAt       *time.Time    `json:"deleted_at,omitempty"`
+	GenreIDs        []int         `json:"genre_ids,omitempty"`
+	Version         int           `json:"version"`
 }
 
-// Author is the definition of a single author
+// Author is the definition of a single author. Photo names the file of
+// their photo and Photos its resized copies, PhotoURL is filled in by the API
+// like a book's CoverURL.
 type Author struct {
 	ID         int       `json:"id"`
 	AuthorName string    `json:"author_name"`
+	Slug       string    `json:"slug"`
+	Bio        string    `json:"bio,omitempty"`
+	Photo      string    `json:"photo,omitempty"`
+	PhotoURL   string    `json:"photo_url,omitempty"`
+	Photos     CoverSet  `json:"photos,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
 }
@@ -36,254 +49,270 @@ type Author struct {
 type Genre struct {
 	ID        int       `json:"id"`
 	GenreName string    `json:"genre_name"`
+	Slug      string    `json:"slug"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// GetAll returns a slice of all books
-func (b *Book) GetAll() ([]*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+type postgresBookStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
-			a.id, a.author_name, a.created_at, a.updated_at
-			from books b
-			left join authors a on (b.author_id = a.id)
-			order by b.title`
+type postgresAuthorStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
 
-	var books []*Book
+type postgresGenreStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
 
-	rows, err := db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
+// bookColumns are the columns scanBook reads, books are aliased b and their
+// author a
+const bookColumns = `b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.cover, b.covers, b.created_at, b.updated_at, b.deleted_at, b.version,
+			a.id, a.author_name, a.slug, a.created_at, a.updated_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBook reads bookColumns, followed by any extra destinations
+func scanBook(row rowScanner, book *Book, extra ...interface{}) error {
+	dest := []interface{}{
+		&book.ID,
+		&book.Title,
+		&book.AuthorID,
+		&book.PublicationYear,
+		&book.Slug,
+		&book.Description,
+		&book.Cover,
+		&book.Covers,
+		&book.CreatedAt,
+		&book.UpdatedAt,
+		&book.DeletedAt,
+		&book.Version,
+		&book.Author.ID,
+		&book.Author.AuthorName,
+		&book.Author.Slug,
+		&book.Author.CreatedAt,
+		&book.Author.UpdatedAt,
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var book Book
-		err := rows.Scan(
-			&book.ID,
-			&book.Title,
-			&book.AuthorID,
-			&book.PublicationYear,
-			&book.Slug,
-			&book.Description,
-			&book.CreatedAt,
-			&book.UpdatedAt,
-			&book.Author.ID,
-			&book.Author.AuthorName,
-			&book.Author.CreatedAt,
-			&book.Author.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
+	return row.Scan(append(dest, extra...)...)
+}
 
-		// get genres
-		genres, ids, err := b.genresForBook(book.ID)
-		if err != nil {
-			return nil, err
-		}
-		book.Genres = genres
-		book.GenreIDs = ids
+// GetAll returns a slice of all books
+func (s *postgresBookStore) GetAll(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
 
-		books = append(books, &book)
-	}
+	query := `select ` + bookColumns + `
+			from books b
+			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is null
+			order by b.title`
 
-	return books, nil
+	return s.queryBooks(ctx, query)
 }
 
 // GetAllPaginated returns a slice of all books, paginated by limit and offset
-func (b *Book) GetAllPaginated(page, pageSize int) ([]*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresBookStore) GetAllPaginated(ctx context.Context, page, pageSize int) ([]*Book, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
 	limit := pageSize
 	offset := (page - 1) * pageSize
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
-			a.id, a.author_name, a.created_at, a.updated_at
+	query := `select ` + bookColumns + `
 			from books b
 			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is null
 			order by b.title
 			limit $1 offset $2`
 
-	var books []*Book
+	return s.queryBooks(ctx, query, limit, offset)
+}
+
+// GetOneById returns one book by its id
+func (s *postgresBookStore) GetOneById(ctx context.Context, id int) (*Book, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + bookColumns + `
+			from books b
+			left join authors a on (b.author_id = a.id)
+			where b.id = $1 and b.deleted_at is null`
+
+	return s.queryBook(ctx, query, id)
+}
+
+// GetOneBySlug returns one book by slug
+func (s *postgresBookStore) GetOneBySlug(ctx context.Context, slug string) (*Book, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + bookColumns + `
+			from books b
+			left join authors a on (b.author_id = a.id)
+			where b.slug = $1 and b.deleted_at is null`
 
-	rows, err := db.QueryContext(ctx, query, limit, offset)
+	return s.queryBook(ctx, query, slug)
+}
+
+// queryBooks runs a query selecting bookColumns and loads the genres of every
+// book it returns with one more query
+func (s *postgresBookStore) queryBooks(ctx context.Context, query string, args ...interface{}) ([]*Book, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var books []*Book
+
 	for rows.Next() {
 		var book Book
-		err := rows.Scan(
-			&book.ID,
-			&book.Title,
-			&book.AuthorID,
-			&book.PublicationYear,
-			&book.Slug,
-			&book.Description,
-			&book.CreatedAt,
-			&book.UpdatedAt,
-			&book.Author.ID,
-			&book.Author.AuthorName,
-			&book.Author.CreatedAt,
-			&book.Author.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-
-		// get genres
-		genres, ids, err := b.genresForBook(book.ID)
-		if err != nil {
+		if err := scanBook(rows, &book); err != nil {
 			return nil, err
 		}
-		book.Genres = genres
-		book.GenreIDs = ids
-
 		books = append(books, &book)
 	}
 
-	return books, nil
-}
-
-// GetOneById returns one book by its id
-func (b *Book) GetOneById(id int) (*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
-			a.id, a.author_name, a.created_at, a.updated_at
-			from books b
-			left join authors a on (b.author_id = a.id)
-			where b.id = $1`
-
-	row := db.QueryRowContext(ctx, query, id)
-
-	var book Book
-
-	err := row.Scan(
-		&book.ID,
-		&book.Title,
-		&book.AuthorID,
-		&book.PublicationYear,
-		&book.Slug,
-		&book.Description,
-		&book.CreatedAt,
-		&book.UpdatedAt,
-		&book.Author.ID,
-		&book.Author.AuthorName,
-		&book.Author.CreatedAt,
-		&book.Author.UpdatedAt)
-	if err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	// get genres
-	genres, ids, err := b.genresForBook(book.ID)
-	if err != nil {
+	if err := s.loadRelations(ctx, books); err != nil {
 		return nil, err
 	}
-	book.Genres = genres
-	book.GenreIDs = ids
 
-	return &book, nil
+	return books, nil
 }
 
-// GetOneBySlug returns one book by slug
-func (b *Book) GetOneBySlug(slug string) (*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
-			a.id, a.author_name, a.created_at, a.updated_at
-			from books b
-			left join authors a on (b.author_id = a.id)
-			where b.slug = $1`
-
-	row := db.QueryRowContext(ctx, query, slug)
-
+// queryBook runs a query selecting bookColumns for a single book
+func (s *postgresBookStore) queryBook(ctx context.Context, query string, args ...interface{}) (*Book, error) {
 	var book Book
 
-	err := row.Scan(
-		&book.ID,
-		&book.Title,
-		&book.AuthorID,
-		&book.PublicationYear,
-		&book.Slug,
-		&book.Description,
-		&book.CreatedAt,
-		&book.UpdatedAt,
-		&book.Author.ID,
-		&book.Author.AuthorName,
-		&book.Author.CreatedAt,
-		&book.Author.UpdatedAt)
+	err := scanBook(s.db.QueryRowContext(ctx, query, args...), &book)
 	if err != nil {
 		return nil, err
 	}
 
-	// get genres
-	genres, ids, err := b.genresForBook(book.ID)
-	if err != nil {
+	if err := s.loadRelations(ctx, []*Book{&book}); err != nil {
 		return nil, err
 	}
-	book.Genres = genres
-	book.GenreIDs = ids
 
 	return &book, nil
 }
 
-// genresForBook returns all genres for a given book id
-func (b *Book) genresForBook(id int) ([]Genre, []int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// loadRelations fills in the genres and contributors of all the given books
+func (s *postgresBookStore) loadRelations(ctx context.Context, books []*Book) error {
+	if err := s.loadGenres(ctx, books); err != nil {
+		return err
+	}
 
-	// get genres
-	var genres []Genre
-	var genreIDs []int
-	genreQuery := `select id, genre_name, created_at, updated_at from genres where id in (select genre_id 
-				from books_genres where book_id = $1) order by genre_name`
+	return s.loadContributors(ctx, books)
+}
 
-	gRows, err := db.QueryContext(ctx, genreQuery, id)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, nil, err
+// loadGenres fills in the genres of all the given books with a single query
+func (s *postgresBookStore) loadGenres(ctx context.Context, books []*Book) error {
+	if len(books) == 0 {
+		return nil
 	}
-	defer gRows.Close()
 
-	var genre Genre
-	for gRows.Next() {
+	byID := make(map[int]*Book, len(books))
+	var ids []int
+	for _, book := range books {
+		byID[book.ID] = book
+		ids = append(ids, book.ID)
+	}
+
+	query := `select bg.book_id, g.id, g.genre_name, g.slug, g.created_at, g.updated_at
+			from books_genres bg
+			join genres g on (g.id = bg.genre_id)
+			where bg.book_id = any($1)
+			order by g.genre_name`
+
+	rows, err := s.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		err = gRows.Scan(
+	for rows.Next() {
+		var bookID int
+		var genre Genre
+		err := rows.Scan(
+			&bookID,
 			&genre.ID,
 			&genre.GenreName,
+			&genre.Slug,
 			&genre.CreatedAt,
 			&genre.UpdatedAt)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
-		genres = append(genres, genre)
-		genreIDs = append(genreIDs, genre.ID)
+
+		book := byID[bookID]
+		book.Genres = append(book.Genres, genre)
+		book.GenreIDs = append(book.GenreIDs, genre.ID)
 	}
 
-	return genres, genreIDs, nil
+	return rows.Err()
 }
 
-// Insert saves one book to the database
-func (b *Book) Insert(book Book) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// NextID reserves an id for a book about to be inserted, so its cover can
+// be stored under it first
+func (s *postgresBookStore) NextID(ctx context.Context) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	stmt := `insert into books (title, author_id, publication_year, slug, description, created_at, updated_at)
-			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	var id int
+	err := s.db.QueryRowContext(ctx, `select nextval(pg_get_serial_sequence('books', 'id'))`).Scan(&id)
+	return id, err
+}
+
+// Insert saves one book with its genres and contributors to the database in
+// one transaction. Its slug is made from the title, with a number added when
+// another book has or had it. The book gets a new id unless one was reserved
+// with NextID.
+func (s *postgresBookStore) Insert(ctx context.Context, book Book) (int, error) {
+	contributors, err := normalizeContributors(&book)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	slug, err := bookSlug(ctx, tx, book.Title, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `insert into books (id, title, author_id, publication_year, slug, description, cover, covers, created_at, updated_at)
+			values (coalesce(nullif($1::int, 0), nextval(pg_get_serial_sequence('books', 'id'))), $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			returning id`
 
 	var newID int
-	err := db.QueryRowContext(ctx, stmt,
+	err = tx.QueryRowContext(ctx, stmt,
+		book.ID,
 		book.Title,
 		book.AuthorID,
 		book.PublicationYear,
-		slugify.Slugify(book.Title),
+		slug,
 		book.Description,
+		book.Cover,
+		book.Covers,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -291,109 +320,224 @@ func (b *Book) Insert(book Book) (int, error) {
 		return 0, err
 	}
 
-	// update genres using genre ids
-	if len(book.GenreIDs) > 0 {
-		stmt = `delete from books_genres where book_id = $1`
-		_, err := db.ExecContext(ctx, stmt, book.ID)
-		if err != nil {
-			return newID, fmt.Errorf("book updated, but genres not: %s", err.Error())
-		}
+	if err := setGenres(ctx, tx, newID, book.GenreIDs); err != nil {
+		return 0, err
+	}
 
-		// add new genres
-		for _, x := range book.GenreIDs {
-			stmt = `insert into books_genres (book_id, genre_id, created_at, updated_at)
-				values ($1, $2, $3, $4)`
-			_, err = db.ExecContext(ctx, stmt, newID, x, time.Now(), time.Now())
-			if err != nil {
-				return newID, fmt.Errorf("book updated, but genres not: %s", err.Error())
-			}
-		}
+	if err := setContributors(ctx, tx, newID, contributors); err != nil {
+		return 0, err
+	}
+
+	if err := recordRevision(ctx, tx, newID, RevisionCreate); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
 
 	return newID, nil
 }
 
-// Update updates one book in the database
-func (b *Book) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Update updates one book in the database in one transaction. Genres are
+// replaced when GenreIDs is not empty, and contributors when Contributors is
+// not nil, otherwise only the primary author changes. When a new title changes
+// the slug the old one is kept in the book's slug history. A non-zero Version
+// must be the book's current one, or ErrEditConflict is returned.
+func (s *postgresBookStore) Update(ctx context.Context, b Book) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.update(ctx, tx, b); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, b.ID, RevisionUpdate); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// update makes the changes of Update in tx
+func (s *postgresBookStore) update(ctx context.Context, tx *sql.Tx, b Book) error {
+	var contributors []Contributor
+	if b.Contributors != nil {
+		var err error
+		contributors, err = normalizeContributors(&b)
+		if err != nil {
+			return err
+		}
+	}
+
+	var oldSlug string
+	var version int
+	err := tx.QueryRowContext(ctx, `select slug, version from books where id = $1 and deleted_at is null for update`,
+		b.ID).Scan(&oldSlug, &version)
+	if err != nil {
+		return err
+	}
+
+	if b.Version != 0 && b.Version != version {
+		return ErrEditConflict
+	}
+
+	slug, err := bookSlug(ctx, tx, b.Title, b.ID)
+	if err != nil {
+		return err
+	}
+
 	stmt := `update books set
 		title = $1,
 		author_id = $2,
 		publication_year = $3,
-        slug = $4,
-    	description = $5,
-		updated_at = $6
-		where id = $7`
-
-	_, err := db.ExecContext(ctx, stmt,
+		slug = $4,
+		description = $5,
+		cover = case when $6 = '' then cover else $6 end,
+		covers = case when $6 = '' then covers else $7 end,
+		updated_at = $8,
+		version = version + 1
+		where id = $9 and deleted_at is null`
+
+	result, err := tx.ExecContext(ctx, stmt,
 		b.Title,
 		b.AuthorID,
 		b.PublicationYear,
-		slugify.Slugify(b.Title),
+		slug,
 		b.Description,
+		b.Cover,
+		b.Covers,
 		time.Now(),
 		b.ID)
 	if err != nil {
 		return err
 	}
 
-	// update genres using genre ids
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := moveSlug(ctx, tx, b.ID, oldSlug, slug); err != nil {
+		return err
+	}
+
 	if len(b.GenreIDs) > 0 {
 		stmt = `delete from books_genres where book_id = $1`
-		_, err := db.ExecContext(ctx, stmt, b.ID)
+		if _, err := tx.ExecContext(ctx, stmt, b.ID); err != nil {
+			return err
+		}
+
+		if err := setGenres(ctx, tx, b.ID, b.GenreIDs); err != nil {
+			return err
+		}
+	}
+
+	if contributors == nil {
+		b.Contributors, err = contributorsForUpdate(ctx, tx, b.ID)
 		if err != nil {
-			return fmt.Errorf("book updated, but genres not: %s", err.Error())
+			return err
 		}
 
-		// add new genres
-		for _, x := range b.GenreIDs {
-			stmt = `insert into books_genres (book_id, genre_id, created_at, updated_at)
-				values ($1, $2, $3, $4)`
-			_, err = db.ExecContext(ctx, stmt, b.ID, x, time.Now(), time.Now())
-			if err != nil {
-				return fmt.Errorf("book updated, but genres not: %s", err.Error())
-			}
+		contributors, err = normalizeContributors(&b)
+		if err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return setContributors(ctx, tx, b.ID, contributors)
 }
 
-// DeleteByID deletes a book by id
-func (b *Book) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// SetCover records the file name of a book's cover and its resized copies.
+// Like Update it returns ErrEditConflict when version is set and the book
+// is no longer at it.
+func (s *postgresBookStore) SetCover(ctx context.Context, id int, cover string, covers CoverSet, version int) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	stmt := `delete from books where id = $1`
-	_, err := db.ExecContext(ctx, stmt, id)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	var current int
+	err = tx.QueryRowContext(ctx, `select version from books where id = $1 and deleted_at is null for update`, id).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if version != 0 && version != current {
+		return ErrEditConflict
+	}
+
+	stmt := `update books set cover = $1, covers = $2, updated_at = $3, version = version + 1 where id = $4`
+
+	if _, err := tx.ExecContext(ctx, stmt, cover, covers, time.Now(), id); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, id, RevisionCover); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setGenres links a book to each of genreIDs
+func setGenres(ctx context.Context, tx *sql.Tx, bookID int, genreIDs []int) error {
+	stmt := `insert into books_genres (book_id, genre_id, created_at, updated_at)
+		values ($1, $2, $3, $4)`
+
+	for _, id := range genreIDs {
+		if _, err := tx.ExecContext(ctx, stmt, bookID, id, time.Now(), time.Now()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// All returns a list of all authors
-func (a *Author) All() ([]*Author, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteByID moves a book to the trash, it stays there until it is restored
+// or purged
+func (s *postgresBookStore) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	query := `select id, author_name, created_at, updated_at  from authors order by author_name`
-	rows, err := db.QueryContext(ctx, query)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var authors []*Author
+	defer tx.Rollback()
 
-	for rows.Next() {
-		var author Author
-		err := rows.Scan(&author.ID, &author.AuthorName, &author.CreatedAt, &author.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		authors = append(authors, &author)
+	stmt := `update books set deleted_at = $1, version = version + 1 where id = $2 and deleted_at is null`
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
 	}
-	return authors, nil
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := recordRevision(ctx, tx, id, RevisionDelete); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// benchmarkPageSize is how many books a listing page holds in the genre
+// loading benchmarks
+const benchmarkPageSize = 50
+
+// BenchmarkLoadGenres compares loading the genres of a page of books with
+// one query per book against one query for the whole page. The roundtrip
+// stores answer every query after a fixed delay, standing in for the
+// network between the api and postgres, and a real database is added when
+// TEST_DSN is set.
+func BenchmarkLoadGenres(b *testing.B) {
+	type namedStore struct {
+		name  string
+		store *postgresBookStore
+	}
+
+	stores := []namedStore{
+		{"roundtrip-200us", &postgresBookStore{db: sql.OpenDB(roundTripConnector{delay: 200 * time.Microsecond}), timeouts: DefaultTimeouts}},
+		{"roundtrip-1ms", &postgresBookStore{db: sql.OpenDB(roundTripConnector{delay: time.Millisecond}), timeouts: DefaultTimeouts}},
+	}
+
+	ids := make([]int, benchmarkPageSize)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+
+	if models, ok := testStores(b)["postgres"]; ok {
+		seeded, err := seedBooks(models, benchmarkPageSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		stores = append(stores, namedStore{"postgres", models.Book.(*postgresBookStore)})
+		ids = seeded
+	}
+
+	ctx := context.Background()
+
+	for _, s := range stores {
+		store := s.store
+
+		b.Run(s.name+"/per-book", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, book := range pageOfBooks(ids) {
+					if err := store.loadGenres(ctx, []*Book{book}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(s.name+"/batched", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := store.loadGenres(ctx, pageOfBooks(ids)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func pageOfBooks(ids []int) []*Book {
+	books := make([]*Book, len(ids))
+	for i, id := range ids {
+		books[i] = &Book{ID: id}
+	}
+	return books
+}
+
+// seedBooks saves n books with two genres each and returns their ids
+func seedBooks(models Models, n int) ([]int, error) {
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+
+	authorID, err := models.Author.Insert(ctx, Author{AuthorName: fmt.Sprintf("Benchmark Author %d", suffix)})
+	if err != nil {
+		return nil, err
+	}
+
+	var genreIDs []int
+	for _, name := range []string{"Benchmark Horror", "Benchmark Fantasy"} {
+		id, err := models.Genre.Insert(ctx, Genre{GenreName: fmt.Sprintf("%s %d", name, suffix)})
+		if err != nil {
+			return nil, err
+		}
+		genreIDs = append(genreIDs, id)
+	}
+
+	var ids []int
+	for i := 0; i < n; i++ {
+		id, err := models.Book.Insert(ctx, Book{
+			Title:           fmt.Sprintf("Benchmark Book %d %d", suffix, i),
+			AuthorID:        authorID,
+			PublicationYear: 2000,
+			GenreIDs:        genreIDs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// roundTripConnector is a database that answers the genre query of
+// loadGenres with two genres for every book asked for, after delay
+type roundTripConnector struct {
+	delay time.Duration
+}
+
+func (c roundTripConnector) Connect(context.Context) (driver.Conn, error) {
+	return roundTripConn(c), nil
+}
+
+func (c roundTripConnector) Driver() driver.Driver {
+	return nil
+}
+
+type roundTripConn struct {
+	delay time.Duration
+}
+
+func (c roundTripConn) Prepare(string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c roundTripConn) Close() error {
+	return nil
+}
+
+func (c roundTripConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+// CheckNamedValue accepts the []int loadGenres passes for any($1)
+func (c roundTripConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (c roundTripConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	// spin rather than sleep, timers are too coarse for delays this short
+	for start := time.Now(); time.Since(start) < c.delay; {
+	}
+
+	ids, ok := args[0].Value.([]int)
+	if !ok {
+		return nil, fmt.Errorf("roundtrip: unexpected argument %T", args[0].Value)
+	}
+
+	return &roundTripRows{ids: ids}, nil
+}
+
+type roundTripRows struct {
+	ids []int
+	n   int
+}
+
+func (r *roundTripRows) Columns() []string {
+	return []string{"book_id", "id", "genre_name", "slug", "created_at", "updated_at"}
+}
+
+func (r *roundTripRows) Close() error {
+	return nil
+}
+
+func (r *roundTripRows) Next(dest []driver.Value) error {
+	if r.n == len(r.ids)*2 {
+		return io.EOF
+	}
+
+	genreID := int64(r.n%2 + 1)
+	dest[0] = int64(r.ids[r.n/2])
+	dest[1] = genreID
+	dest[2] = fmt.Sprintf("Genre %d", genreID)
+	dest[3] = fmt.Sprintf("genre-%d", genreID)
+	dest[4] = time.Time{}
+	dest[5] = time.Time{}
+	r.n++
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// roles a contributor can have on a book
+const (
+	ContributorAuthor      = "author"
+	ContributorCoAuthor    = "co-author"
+	ContributorEditor      = "editor"
+	ContributorTranslator  = "translator"
+	ContributorIllustrator = "illustrator"
+)
+
+var contributorRoles = []string{
+	ContributorAuthor,
+	ContributorCoAuthor,
+	ContributorEditor,
+	ContributorTranslator,
+	ContributorIllustrator,
+}
+
+// Contributor credits an author with a role on a book, Position orders the
+// credits starting from 0
+type Contributor struct {
+	AuthorID   int    `json:"author_id"`
+	AuthorName string `json:"author_name"`
+	Slug       string `json:"slug"`
+	Role       string `json:"role"`
+	Position   int    `json:"position"`
+}
+
+// ValidContributorRole reports whether role is one of the known roles
+func ValidContributorRole(role string) bool {
+	for _, r := range contributorRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeContributors returns the credits to save for book. The primary
+// author always comes first with the author role, taken from the first
+// author in Contributors when AuthorID is not set. A credit without a role
+// is an author credit. Duplicates are dropped and positions renumbered.
+func normalizeContributors(book *Book) ([]Contributor, error) {
+	for i := range book.Contributors {
+		if book.Contributors[i].Role == "" {
+			book.Contributors[i].Role = ContributorAuthor
+		}
+	}
+
+	if book.AuthorID == 0 {
+		for _, c := range book.Contributors {
+			if c.Role == ContributorAuthor {
+				book.AuthorID = c.AuthorID
+				break
+			}
+		}
+	}
+
+	credits := append([]Contributor{{AuthorID: book.AuthorID, Role: ContributorAuthor}}, book.Contributors...)
+
+	var contributors []Contributor
+	seen := map[Contributor]bool{}
+	for _, c := range credits {
+		if !ValidContributorRole(c.Role) {
+			return nil, fmt.Errorf("unknown contributor role %q", c.Role)
+		}
+
+		key := Contributor{AuthorID: c.AuthorID, Role: c.Role}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		key.Position = len(contributors)
+		contributors = append(contributors, key)
+	}
+
+	return contributors, nil
+}
+
+// setContributors replaces the credits of a book
+func setContributors(ctx context.Context, tx *sql.Tx, bookID int, contributors []Contributor) error {
+	if _, err := tx.ExecContext(ctx, `delete from book_contributors where book_id = $1`, bookID); err != nil {
+		return err
+	}
+
+	stmt := `insert into book_contributors (book_id, author_id, role, position, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	for _, c := range contributors {
+		if _, err := tx.ExecContext(ctx, stmt, bookID, c.AuthorID, c.Role, c.Position, time.Now(), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// contributorsForUpdate returns the credits a book keeps when an update does
+// not list any: everyone but the previous primary author
+func contributorsForUpdate(ctx context.Context, tx *sql.Tx, bookID int) ([]Contributor, error) {
+	query := `select author_id, role from book_contributors where book_id = $1 and position > 0 order by position`
+
+	rows, err := tx.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributors := []Contributor{}
+	for rows.Next() {
+		var c Contributor
+		if err := rows.Scan(&c.AuthorID, &c.Role); err != nil {
+			return nil, err
+		}
+		contributors = append(contributors, c)
+	}
+
+	return contributors, rows.Err()
+}
+
+// loadContributors fills in the credits of all the given books with a single
+// query
+func (s *postgresBookStore) loadContributors(ctx context.Context, books []*Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Book, len(books))
+	var ids []int
+	for _, book := range books {
+		byID[book.ID] = book
+		ids = append(ids, book.ID)
+	}
+
+	query := `select bc.book_id, a.id, a.author_name, a.slug, bc.role, bc.position
+			from book_contributors bc
+			join authors a on (a.id = bc.author_id)
+			where bc.book_id = any($1)
+			order by bc.position`
+
+	rows, err := s.db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID int
+		var c Contributor
+		err := rows.Scan(
+			&bookID,
+			&c.AuthorID,
+			&c.AuthorName,
+			&c.Slug,
+			&c.Role,
+			&c.Position)
+		if err != nil {
+			return err
+		}
+
+		book := byID[bookID]
+		book.Contributors = append(book.Contributors, c)
+	}
+
+	return rows.Err()
+}
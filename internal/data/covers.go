@@ -0,0 +1,78 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// CoverImage is one resized copy of a book's cover. Name is the file it is
+// stored as, URL is only filled in when the book is sent to a client since
+// it depends on the storage backend.
+type CoverImage struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// CoverSize holds one size of a cover in every format it is generated in
+type CoverSize struct {
+	JPEG CoverImage `json:"jpeg"`
+	WebP CoverImage `json:"webp"`
+}
+
+// CoverSet is every generated size of a cover, keyed by size name such as
+// "thumbnail". It is stored as a json column.
+type CoverSet map[string]CoverSize
+
+// Value implements driver.Valuer, urls are never stored
+func (c CoverSet) Value() (driver.Value, error) {
+	stored := CoverSet{}
+	for size, images := range c {
+		images.JPEG.URL = ""
+		images.WebP.URL = ""
+		stored[size] = images
+	}
+
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (c *CoverSet) Scan(src interface{}) error {
+	var b []byte
+
+	switch v := src.(type) {
+	case nil:
+		*c = CoverSet{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.New("covers: unsupported type")
+	}
+
+	set := CoverSet{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+
+	*c = set
+	return nil
+}
+
+// Files returns the name of every image in the set
+func (c CoverSet) Files() []string {
+	var names []string
+	for _, size := range c {
+		names = append(names, size.JPEG.Name, size.WebP.Name)
+	}
+	return names
+}
@@ -2,65 +2,103 @@ package data
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/base32"
 	"errors"
 	"net/http"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-const dbTimeout = time.Second * 3
+// Timeouts are the default deadlines for database operations. They are layered
+// on top of the caller's context, so a request deadline or a client disconnect
+// still cancels the query first.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
 
-var db *sql.DB
+// DefaultTimeouts cancels any query that takes longer than 3 seconds
+var DefaultTimeouts = Timeouts{
+	Read:  time.Second * 3,
+	Write: time.Second * 3,
+}
 
-func New(dbPool *sql.DB) Models {
-	db = dbPool
+func (t Timeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, t.Read)
+}
 
+func (t Timeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, t.Write)
+}
+
+// New returns the models backed by the postgres database pool
+func New(dbPool *sql.DB, timeouts Timeouts) Models {
 	return Models{
-		User:   User{},
-		Token:  Token{},
-		Book:   Book{},
-		Author: Author{},
+		User:          &postgresUserStore{db: dbPool, timeouts: timeouts},
+		Token:         &postgresTokenStore{db: dbPool, timeouts: timeouts},
+		RefreshToken:  &postgresRefreshTokenStore{db: dbPool, timeouts: timeouts},
+		PasswordReset: &postgresPasswordResetStore{db: dbPool, timeouts: timeouts},
+		LoginAttempt:  &postgresLoginAttemptStore{db: dbPool, timeouts: timeouts},
+		MFA:           &postgresMFAStore{db: dbPool, timeouts: timeouts},
+		Book:          &postgresBookStore{db: dbPool, timeouts: timeouts},
+		Author:        &postgresAuthorStore{db: dbPool, timeouts: timeouts},
+		Genre:         &postgresGenreStore{db: dbPool, timeouts: timeouts},
+		Audit:         &postgresAuditStore{db: dbPool, timeouts: timeouts},
 	}
 }
 
+// Models is the collection of stores the application works with
 type Models struct {
-	User   User
-	Token  Token
-	Book   Book
-	Author Author
+	User          UserStore
+	Token         TokenStore
+	RefreshToken  RefreshTokenStore
+	PasswordReset PasswordResetStore
+	LoginAttempt  LoginAttemptStore
+	MFA           MFAStore
+	Book          BookStore
+	Author        AuthorStore
+	Genre         GenreStore
+	Audit         AuditStore
+}
+
+type postgresUserStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+type postgresTokenStore struct {
+	db       *sql.DB
+	timeouts Timeouts
 }
 
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"password"`
-	Active    int       `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Token     Token     `json:"token"`
+	ID        int        `json:"id"`
+	Email     string     `json:"email"`
+	FirstName string     `json:"first_name,omitempty"`
+	LastName  string     `json:"last_name,omitempty"`
+	Password  string     `json:"password"`
+	Active    int        `json:"active"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Version   int        `json:"version"`
+	Token     Token      `json:"token"`
 }
 
-func (u *User) GetAllUsers() ([]*User, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresUserStore) GetAllUsers(ctx context.Context) ([]*User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at,
+	query := `select id, email, first_name, last_name, password, user_active, role, created_at, updated_at, version,
 	case
 		when (select count(id) from tokens t where user_id = users.id and t.expiry > NOW()) > 0 then 1
 		else 0
 	end as has_token
-	from users order by last_name`
+	from users where deleted_at is null order by last_name`
 
-	rows, err := db.QueryContext(ctx, query)
+	rows, err := s.db.QueryContext(ctx, query)
 
 	if err != nil {
 		return nil, err
@@ -79,8 +117,10 @@ func (u *User) GetAllUsers() ([]*User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.Active,
+			&user.Role,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.Version,
 			&user.Token.ID,
 		)
 		if err != nil {
@@ -92,15 +132,13 @@ func (u *User) GetAllUsers() ([]*User, error) {
 	return users, nil
 }
 
-func (u *User) GetUserByEmail(email string) (*User, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, user_active, role, created_at, updated_at, version from users where email = $1 and deleted_at is null`
 
-	row := db.QueryRowContext(ctx, query, email)
-	println(row)
+	row := s.db.QueryRowContext(ctx, query, email)
 
 	var user User
 
@@ -111,8 +149,10 @@ func (u *User) GetUserByEmail(email string) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 
 	if err != nil {
@@ -122,14 +162,13 @@ func (u *User) GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (u *User) GetUserById(id int) (*User, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresUserStore) GetUserById(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, role, created_at, updated_at, version from users where id = $1 and deleted_at is null`
 
-	row := db.QueryRowContext(ctx, query, id)
+	row := s.db.QueryRowContext(ctx, query, id)
 
 	var user User
 
@@ -140,8 +179,10 @@ func (u *User) GetUserById(id int) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 
 	if err != nil {
@@ -151,9 +192,11 @@ func (u *User) GetUserById(id int) (*User, error) {
 	return &user, nil
 }
 
-func (u *User) UpdateUser() error {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// UpdateUser saves the details of a user and returns their new version. A
+// non-zero Version must be the user's current one, or ErrEditConflict is
+// returned.
+func (s *postgresUserStore) UpdateUser(ctx context.Context, u User) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
 	query := `update users set
@@ -161,29 +204,47 @@ func (u *User) UpdateUser() error {
 			first_name = $2,
 			last_name = $3,
 			user_active = $4,
-			updated_at = $5
-			where id = $6
+			role = $5,
+			updated_at = $6,
+			version = version + 1
+			where id = $7 and deleted_at is null and ($8 = 0 or version = $8)
+			returning version
 	`
 
-	_, err := db.ExecContext(ctx, query,
+	var version int
+	err := s.db.QueryRowContext(ctx, query,
 		u.Email,
 		u.FirstName,
 		u.LastName,
 		u.Active,
+		u.Role,
 		time.Now(),
 		u.ID,
-	)
+		u.Version,
+	).Scan(&version)
 
-	if err != nil {
-		return err
+	if err == nil {
+		return version, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
 	}
 
-	return nil
+	// nothing was updated, either the user is gone or the version is stale
+	var exists bool
+	query = `select exists (select 1 from users where id = $1 and deleted_at is null)`
+	if err := s.db.QueryRowContext(ctx, query, u.ID).Scan(&exists); err != nil {
+		return 0, err
+	}
+
+	if exists {
+		return 0, ErrEditConflict
+	}
+
+	return 0, sql.ErrNoRows
 }
 
-func (u *User) AddUser(user User) (int, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresUserStore) AddUser(ctx context.Context, user User) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
 	//create has password
@@ -195,14 +256,19 @@ func (u *User) AddUser(user User) (int, error) {
 
 	var userId int
 
-	query := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	if user.Role == "" {
+		user.Role = RoleViewer
+	}
+
+	query := `insert into users (email, first_name, last_name, password, user_active, role, created_at, updated_at) values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
-	err = db.QueryRowContext(ctx, query,
+	err = s.db.QueryRowContext(ctx, query,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
 		user.Active,
+		user.Role,
 		time.Now(),
 		time.Now(),
 	).Scan(&userId)
@@ -215,9 +281,8 @@ func (u *User) AddUser(user User) (int, error) {
 	return userId, nil
 }
 
-func (u *User) ResetUserPassword(password string) error {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresUserStore) ResetUserPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
 	//create has password
@@ -227,9 +292,9 @@ func (u *User) ResetUserPassword(password string) error {
 		return err
 	}
 
-	query := `update users set password = $1 where id = $2`
+	query := `update users set password = $1 where id = $2 and deleted_at is null`
 
-	_, err = db.ExecContext(ctx, query, hashedPassword, u.ID)
+	_, err = s.db.ExecContext(ctx, query, hashedPassword, id)
 
 	if err != nil {
 		return err
@@ -254,69 +319,91 @@ func (u *User) UserPasswordMatch(plainPassword string) (bool, error) {
 	return true, nil
 }
 
-func (u *User) DeleteUser() error {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// dummyPasswordHash is a bcrypt hash of a password nobody knows
+const dummyPasswordHash = "$2a$10$tPN4srE9QRJn4Z57PWMeuO/HYVOmw6qhQn5i/40Fa/Ek2WcJhZeCi"
 
-	query := `delete from users where id = $1`
+// DummyPasswordMatch does the same bcrypt work as UserPasswordMatch and always
+// fails, so a login for an unknown email takes as long as a wrong password
+func DummyPasswordMatch(plainPassword string) {
+	_ = bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(plainPassword))
+}
 
-	_, err := db.ExecContext(ctx, query, u.ID)
+// DeleteUserById moves a user to the trash and ends all their sessions
+func (s *postgresUserStore) DeleteUserById(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
 
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
-}
+	query := `update users set deleted_at = $1, version = version + 1 where id = $2 and deleted_at is null`
 
-func (u *User) DeleteUserById(id int) error {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+	result, err := tx.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-	query := `delete from users where id = $1`
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
 
-	_, err := db.ExecContext(ctx, query, id)
+	query = `with t as (delete from tokens where user_id = $1)
+	delete from refresh_tokens where user_id = $1`
 
-	if err != nil {
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
+// Token is a single login session for a user
 type Token struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Email     string    `json:"email"`
-	Token     string    `json:"token"`
-	TokenHash []byte    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Expiry    time.Time `json:"expiry"`
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	Email      string    `json:"email"`
+	Token      string    `json:"token,omitempty"`
+	TokenHash  []byte    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Expiry     time.Time `json:"expiry"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	FamilyID   string    `json:"-"`
 }
 
-func (t *Token) GetUserByToken(plainText string) (*Token, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresTokenStore) GetUserByToken(ctx context.Context, plainText string) (*Token, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
-	query := `select id, user_id, email, token, token_hash, created_at, updated_at, expiry from tokens where token = $1`
+	query := `select id, user_id, email, token_hash, created_at, updated_at, expiry, last_used_at, user_agent, ip_address,
+	family_id from tokens where token_hash = $1`
 
 	var token Token
 
-	row := db.QueryRowContext(ctx, query, plainText)
+	row := s.db.QueryRowContext(ctx, query, hashToken(plainText))
 
 	err := row.Scan(
 		&token.ID,
 		&token.UserID,
 		&token.Email,
-		&token.Token,
 		&token.TokenHash,
 		&token.CreatedAt,
 		&token.UpdatedAt,
 		&token.Expiry,
+		&token.LastUsedAt,
+		&token.UserAgent,
+		&token.IPAddress,
+		&token.FamilyID,
 	)
 
 	if err != nil {
@@ -326,14 +413,13 @@ func (t *Token) GetUserByToken(plainText string) (*Token, error) {
 	return &token, nil
 }
 
-func (t *Token) GetUserForToken(token Token) (*User, error) {
-	// if it takes longer than 3 seconds, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresTokenStore) GetUserForToken(ctx context.Context, token Token) (*User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, role, created_at, updated_at, version from users where id = $1 and deleted_at is null`
 
-	row := db.QueryRowContext(ctx, query, token.UserID)
+	row := s.db.QueryRowContext(ctx, query, token.UserID)
 
 	var user User
 
@@ -344,8 +430,10 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 
 	if err != nil {
@@ -355,73 +443,25 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 	return &user, nil
 }
 
-// generate token
-func (t *Token) GenerateToken(userID int, ttl time.Duration) (*Token, error) {
-	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-	}
-
-	randomBytes := make([]byte, 16)
-
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	token.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.Token))
-	token.TokenHash = hash[:]
-
-	return token, nil
+// GenerateToken creates a new random token for a user, it is not saved
+func (s *postgresTokenStore) GenerateToken(userID int, ttl time.Duration) (*Token, error) {
+	return generateToken(userID, ttl)
 }
 
-// Authenticate
-func (t *Token) AuthenticateToken(r *http.Request) (*User, error) {
-	authorizationHeader := r.Header.Get("Authorization")
-	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header")
-	}
-
-	headersParts := strings.Split(authorizationHeader, " ")
-	if len(headersParts) != 2 || headersParts[0] != "Bearer" {
-		return nil, errors.New("no valid header")
-	}
-
-	token := headersParts[1]
-
-	if len(token) != 26 {
-		return nil, errors.New("token size is not valid")
-	}
-
-	tk, err := t.GetUserByToken(token)
-	if err != nil {
-		return nil, errors.New("not matching token found")
-	}
-
-	if tk.Expiry.Before(time.Now()) {
-		return nil, errors.New("expired token")
-	}
-
-	user, err := t.GetUserForToken(*tk)
-	if err != nil {
-		return nil, errors.New("not matching user found")
-	}
-
-	if user.Active == 0 {
-		return nil, errors.New("user not active")
-	}
-
-	return user, nil
+// AuthenticateToken returns the user for the bearer token on the request
+func (s *postgresTokenStore) AuthenticateToken(r *http.Request) (*User, error) {
+	return authenticateToken(s, r)
 }
 
-func (t *Token) DeleteByToken(plain string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresTokenStore) DeleteByToken(ctx context.Context, plain string) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	query := `delete from tokens where token = $1`
+	// the refresh tokens of the same login go with it
+	query := `with t as (delete from tokens where token_hash = $1 returning family_id)
+	delete from refresh_tokens where family_id in (select family_id from t where family_id <> '')`
 
-	_, err := db.ExecContext(ctx, query, plain)
+	_, err := s.db.ExecContext(ctx, query, hashToken(plain))
 
 	if err != nil {
 		return err
@@ -430,28 +470,36 @@ func (t *Token) DeleteByToken(plain string) error {
 	return nil
 }
 
-func (t *Token) InsertToken(token Token, u User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (s *postgresTokenStore) InsertToken(ctx context.Context, token Token, u User) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	query := `delete from tokens where user_id = $1`
+	// users keep their other sessions, only expired tokens of logins that
+	// can no longer be refreshed are cleared out
+	query := `delete from tokens t where t.user_id = $1 and t.expiry < $2 and not exists (
+		select 1 from refresh_tokens r where r.family_id = t.family_id and r.used_at is null and r.expiry > $2)`
 
-	_, err := db.ExecContext(ctx, query, token.UserID)
+	_, err := s.db.ExecContext(ctx, query, token.UserID, time.Now())
 
 	if err != nil {
 		return err
 	}
 
-	query = `insert into tokens (user_id, email, token, token_hash, created_at, updated_at, expiry) values ($1, $2, $3, $4, $5, $6, $7)`
+	// only the hash is persisted, the plaintext is handed to the client once
+	query = `insert into tokens (user_id, email, token_hash, created_at, updated_at, expiry, last_used_at, user_agent, ip_address,
+	family_id) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
 
-	_, err = db.ExecContext(ctx, query,
+	_, err = s.db.ExecContext(ctx, query,
 		token.UserID,
-		token.Email,
-		token.Token,
+		u.Email,
 		token.TokenHash,
 		time.Now(),
 		time.Now(),
 		token.Expiry,
+		time.Now(),
+		token.UserAgent,
+		token.IPAddress,
+		token.FamilyID,
 	)
 
 	if err != nil {
@@ -461,35 +509,106 @@ func (t *Token) InsertToken(token Token, u User) error {
 	return nil
 }
 
-func (t *Token) ValidToken(plain string) (bool, error) {
-	token, err := t.GetUserByToken(plain)
+// ValidToken reports whether plain is an unexpired token for an existing user
+func (s *postgresTokenStore) ValidToken(ctx context.Context, plain string) (bool, error) {
+	return validToken(ctx, s, plain)
+}
+
+func (s *postgresTokenStore) DeleteTokenForUser(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	query := `with t as (delete from tokens where user_id = $1)
+	delete from refresh_tokens where user_id = $1`
+
+	_, err := s.db.ExecContext(ctx, query, id)
 
 	if err != nil {
-		return false, errors.New("no matching found")
+		return err
 	}
+	return nil
+}
+
+// SessionsForUser returns the logins of a user that can still be refreshed,
+// most recently used first. An idle login keeps its session after its
+// access token expires, for as long as its refresh token is valid.
+func (s *postgresTokenStore) SessionsForUser(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
 
-	_, err = t.GetUserForToken(*token)
+	// a family has one unused refresh token and at most one access token
+	query := `select r.family_id, r.user_id, f.created_at, r.expiry,
+	coalesce(t.last_used_at, r.created_at), coalesce(t.user_agent, ''), coalesce(t.ip_address, '')
+	from refresh_tokens r
+	join (select family_id, min(created_at) as created_at from refresh_tokens where user_id = $1 group by family_id) f
+		on f.family_id = r.family_id
+	left join tokens t on t.family_id = r.family_id
+	where r.user_id = $1 and r.used_at is null and r.expiry > $2
+	order by 5 desc`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, time.Now())
 	if err != nil {
-		return false, errors.New("not matching user found")
+		return nil, err
 	}
+	defer rows.Close()
+
+	var sessions []*Session
+
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.LastUsedAt,
+			&session.UserAgent,
+			&session.IPAddress,
+		)
+		if err != nil {
+			return nil, err
+		}
 
-	if token.Expiry.Before(time.Now()) {
-		return false, errors.New("expired token")
+		sessions = append(sessions, &session)
 	}
 
-	return true, nil
+	return sessions, rows.Err()
 }
 
-func (t *Token) DeleteTokenForUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteSession revokes one login of a user, every access and refresh token
+// of its family
+func (s *postgresTokenStore) DeleteSession(ctx context.Context, userID int, id string) error {
+	ctx, cancel := s.timeouts.write(ctx)
 	defer cancel()
 
-	query := `delete from tokens where user_id = $1`
+	query := `with r as (delete from refresh_tokens where family_id = $1 and user_id = $2 returning id),
+	t as (delete from tokens where family_id = $1 and user_id = $2)
+	select count(*) from r`
 
-	_, err := db.ExecContext(ctx, query, id)
+	var deleted int
+	if err := s.db.QueryRowContext(ctx, query, id, userID).Scan(&deleted); err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// TouchToken records that a token has just been used
+func (s *postgresTokenStore) TouchToken(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	query := `update tokens set last_used_at = $1 where id = $2`
+
+	_, err := s.db.ExecContext(ctx, query, time.Now(), id)
 
 	if err != nil {
 		return err
 	}
+
 	return nil
 }
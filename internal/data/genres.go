@@ -0,0 +1,330 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// GenreWithCount is a genre and how many books belong to it
+type GenreWithCount struct {
+	Genre
+	BookCount int `json:"book_count"`
+}
+
+// ErrMergeIntoSelf is returned when a genre is merged into itself
+var ErrMergeIntoSelf = errors.New("cannot merge a genre into itself")
+
+// All returns every genre with the number of books in it
+func (s *postgresGenreStore) All(ctx context.Context) ([]*GenreWithCount, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select g.id, g.genre_name, g.slug, g.created_at, g.updated_at, count(b.id)
+			from genres g
+			left join books_genres bg on (bg.genre_id = g.id)
+			left join books b on (b.id = bg.book_id and b.deleted_at is null)
+			group by g.id
+			order by g.genre_name`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var genres []*GenreWithCount
+
+	for rows.Next() {
+		var genre GenreWithCount
+		err := rows.Scan(
+			&genre.ID,
+			&genre.GenreName,
+			&genre.Slug,
+			&genre.CreatedAt,
+			&genre.UpdatedAt,
+			&genre.BookCount)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &genre)
+	}
+
+	return genres, rows.Err()
+}
+
+// GetOneById returns one genre by id
+func (s *postgresGenreStore) GetOneById(ctx context.Context, id int) (*Genre, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select id, genre_name, slug, created_at, updated_at from genres where id = $1`
+
+	var genre Genre
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&genre.ID,
+		&genre.GenreName,
+		&genre.Slug,
+		&genre.CreatedAt,
+		&genre.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &genre, nil
+}
+
+// GetOneBySlug returns one genre by slug
+func (s *postgresGenreStore) GetOneBySlug(ctx context.Context, slug string) (*Genre, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select id, genre_name, slug, created_at, updated_at from genres where slug = $1`
+
+	var genre Genre
+	err := s.db.QueryRowContext(ctx, query, slug).Scan(
+		&genre.ID,
+		&genre.GenreName,
+		&genre.Slug,
+		&genre.CreatedAt,
+		&genre.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &genre, nil
+}
+
+// Insert saves a new genre, its slug is made from the name and numbered
+// when another genre has it
+func (s *postgresGenreStore) Insert(ctx context.Context, genre Genre) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	slug, err := rowSlug(ctx, tx, "genres", genre.GenreName, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `insert into genres (genre_name, slug, created_at, updated_at) values ($1, $2, $3, $4) returning id`
+
+	var newID int
+	err = tx.QueryRowContext(ctx, stmt,
+		genre.GenreName,
+		slug,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// Update renames a genre
+func (s *postgresGenreStore) Update(ctx context.Context, genre Genre) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	slug, err := rowSlug(ctx, tx, "genres", genre.GenreName, genre.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update genres set genre_name = $1, slug = $2, updated_at = $3 where id = $4`
+
+	result, err := tx.ExecContext(ctx, stmt, genre.GenreName, slug, time.Now(), genre.ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// DeleteByID deletes a genre, books in it simply lose the genre, which is
+// recorded as a new version and revision of each
+func (s *postgresGenreStore) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bookIDs, err := genreBooks(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `delete from genres where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := touchBooks(ctx, tx, bookIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Merge moves every book of genre fromID into genre intoID and deletes
+// fromID, in one transaction
+func (s *postgresGenreStore) Merge(ctx context.Context, fromID, intoID int) error {
+	if fromID == intoID {
+		return ErrMergeIntoSelf
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// both genres must exist, and stay put until the merge is done
+	var found int
+	err = tx.QueryRowContext(ctx, `select count(*) from (select id from genres where id in ($1, $2) for update) g`,
+		fromID, intoID).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found != 2 {
+		return sql.ErrNoRows
+	}
+
+	bookIDs, err := genreBooks(ctx, tx, fromID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into books_genres (book_id, genre_id, created_at, updated_at)
+		select book_id, $1, $2, $2 from books_genres where genre_id = $3
+		on conflict (book_id, genre_id) do nothing`
+	if _, err := tx.ExecContext(ctx, stmt, intoID, time.Now(), fromID); err != nil {
+		return err
+	}
+
+	// remember where fromID went, and where the genres merged into it earlier
+	// went, for reverts to older revisions
+	if _, err := tx.ExecContext(ctx, `update genre_merges set into_id = $1 where into_id = $2`, intoID, fromID); err != nil {
+		return err
+	}
+	stmt = `insert into genre_merges (from_id, into_id, merged_at) values ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, stmt, fromID, intoID, time.Now()); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from genres where id = $1`, fromID); err != nil {
+		return err
+	}
+
+	if err := touchBooks(ctx, tx, bookIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// genreBooks returns the id of every book in genre, trashed ones included
+func genreBooks(ctx context.Context, tx *sql.Tx, genreID int) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `select book_id from books_genres where genre_id = $1 order by book_id`, genreID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// liveGenres returns the genres ids stand for now: a genre that was merged
+// becomes the one it was merged into, and one that was deleted is dropped
+func liveGenres(ctx context.Context, tx *sql.Tx, ids []int) ([]int, error) {
+	query := `select distinct coalesce(g.id, m.into_id)
+		from unnest($1::integer[]) s(id)
+		left join genres g on (g.id = s.id)
+		left join genre_merges m on (m.from_id = s.id)
+		where coalesce(g.id, m.into_id) is not null
+		order by 1`
+
+	rows, err := tx.QueryContext(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	live := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		live = append(live, id)
+	}
+
+	return live, rows.Err()
+}
+
+// touchBooks records a change to the genres of books made in tx as a new
+// version and revision of each, so an edit made from the version before
+// is a conflict
+func touchBooks(ctx context.Context, tx *sql.Tx, bookIDs []int) error {
+	for _, id := range bookIDs {
+		_, err := tx.ExecContext(ctx, `update books set version = version + 1, updated_at = $1 where id = $2`, time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		if err := recordRevision(ctx, tx, id, RevisionGenres); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
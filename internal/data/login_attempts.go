@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// LoginAttempt tracks the recent failed logins for one email or client IP
+type LoginAttempt struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// Locked reports whether the key is locked out at the given time
+func (a *LoginAttempt) Locked(at time.Time) bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(at)
+}
+
+// EmailAttemptKey returns the login attempt key for an email address
+func EmailAttemptKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPAttemptKey returns the login attempt key for a client address
+func IPAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+type postgresLoginAttemptStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+// Get returns the attempts recorded for key, or an empty record if there are none
+func (s *postgresLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempt, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select key, failures, last_failure_at, locked_until from login_attempts where key = $1`
+
+	var attempt LoginAttempt
+	err := s.db.QueryRowContext(ctx, query, key).Scan(
+		&attempt.Key,
+		&attempt.Failures,
+		&attempt.LastFailureAt,
+		&attempt.LockedUntil,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginAttempt{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// RecordFailure counts a failed login for key and returns the new count.
+// Failures older than window are forgotten before counting.
+func (s *postgresLoginAttemptStore) RecordFailure(ctx context.Context, key string, window time.Duration) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `insert into login_attempts (key, failures, last_failure_at) values ($1, 1, $2)
+	on conflict (key) do update set
+		failures = case when login_attempts.last_failure_at < $3 then 1 else login_attempts.failures + 1 end,
+		last_failure_at = $2
+	returning failures`
+
+	now := time.Now()
+
+	var failures int
+	if err := s.db.QueryRowContext(ctx, stmt, key, now, now.Add(-window)).Scan(&failures); err != nil {
+		return 0, err
+	}
+
+	return failures, nil
+}
+
+// Lock stops key from logging in until the given time
+func (s *postgresLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `update login_attempts set locked_until = $1 where key = $2`
+
+	_, err := s.db.ExecContext(ctx, stmt, until, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reset forgets every failure recorded for key, which also unlocks it
+func (s *postgresLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `delete from login_attempts where key = $1`
+
+	_, err := s.db.ExecContext(ctx, stmt, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllLocked returns every key that is currently locked out
+func (s *postgresLoginAttemptStore) AllLocked(ctx context.Context) ([]*LoginAttempt, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select key, failures, last_failure_at, locked_until from login_attempts
+	where locked_until > $1 order by locked_until desc`
+
+	rows, err := s.db.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []*LoginAttempt
+
+	for rows.Next() {
+		var attempt LoginAttempt
+		err := rows.Scan(
+			&attempt.Key,
+			&attempt.Failures,
+			&attempt.LastFailureAt,
+			&attempt.LockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, &attempt)
+	}
+
+	return attempts, nil
+}
@@ -0,0 +1,2150 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/mozillazg/go-slugify"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the memory store reports constraint violations with the same SQLSTATE codes
+// postgres uses, so callers can handle both implementations the same way
+var (
+	errMemoryUniqueViolation = errors.New("duplicate key value violates unique constraint (SQLSTATE 23505)")
+	errMemoryForeignKey      = errors.New("violates foreign key constraint (SQLSTATE 23503)")
+)
+
+// memoryDB holds every table of the in-memory implementation behind one lock
+type memoryDB struct {
+	mu sync.RWMutex
+
+	nextID map[string]int
+
+	users          map[int]User
+	tokens         map[int]Token
+	refreshTokens  map[int]RefreshToken
+	passwordResets map[int]PasswordReset
+	loginAttempts  map[string]LoginAttempt
+	totp           map[int]TOTP
+	recoveryCodes  map[int][]recoveryCode
+	mfaTickets     map[int]MFATicket
+	authors        map[int]Author
+	books          map[int]Book
+	genres         map[int]Genre
+	bookGenres     map[int][]int
+	contributors   map[int][]Contributor
+	bookSlugs      map[string]int
+	revisions      map[int][]BookRevision
+	genreMerges    map[int]int
+	auditLog       []AuditEntry
+}
+
+type memoryUserStore struct {
+	m *memoryDB
+}
+
+type memoryTokenStore struct {
+	m *memoryDB
+}
+
+type memoryRefreshTokenStore struct {
+	m *memoryDB
+}
+
+type memoryPasswordResetStore struct {
+	m *memoryDB
+}
+
+type memoryLoginAttemptStore struct {
+	m *memoryDB
+}
+
+type memoryMFAStore struct {
+	m *memoryDB
+}
+
+// recoveryCode is a row of the recovery_codes table
+type recoveryCode struct {
+	hash []byte
+	used bool
+}
+
+type memoryBookStore struct {
+	m *memoryDB
+}
+
+type memoryAuthorStore struct {
+	m *memoryDB
+}
+
+type memoryGenreStore struct {
+	m *memoryDB
+}
+
+type memoryAuditStore struct {
+	m *memoryDB
+}
+
+// NewMemory returns empty models that keep everything in process memory
+func NewMemory() Models {
+	return newMemoryModels(newMemoryDB())
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		nextID:         map[string]int{},
+		users:          map[int]User{},
+		tokens:         map[int]Token{},
+		refreshTokens:  map[int]RefreshToken{},
+		passwordResets: map[int]PasswordReset{},
+		loginAttempts:  map[string]LoginAttempt{},
+		totp:           map[int]TOTP{},
+		recoveryCodes:  map[int][]recoveryCode{},
+		mfaTickets:     map[int]MFATicket{},
+		authors:        map[int]Author{},
+		books:          map[int]Book{},
+		genres:         map[int]Genre{},
+		bookGenres:     map[int][]int{},
+		contributors:   map[int][]Contributor{},
+		bookSlugs:      map[string]int{},
+		revisions:      map[int][]BookRevision{},
+		genreMerges:    map[int]int{},
+	}
+}
+
+func newMemoryModels(m *memoryDB) Models {
+	return Models{
+		User:          &memoryUserStore{m: m},
+		Token:         &memoryTokenStore{m: m},
+		RefreshToken:  &memoryRefreshTokenStore{m: m},
+		PasswordReset: &memoryPasswordResetStore{m: m},
+		LoginAttempt:  &memoryLoginAttemptStore{m: m},
+		MFA:           &memoryMFAStore{m: m},
+		Book:          &memoryBookStore{m: m},
+		Author:        &memoryAuthorStore{m: m},
+		Genre:         &memoryGenreStore{m: m},
+		Audit:         &memoryAuditStore{m: m},
+	}
+}
+
+// id returns the next serial value for a table, the caller must hold the lock
+func (m *memoryDB) id(table string) int {
+	m.nextID[table]++
+	return m.nextID[table]
+}
+
+// Users
+
+func (s *memoryUserStore) GetAllUsers(ctx context.Context) ([]*User, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var users []*User
+	for _, u := range s.m.users {
+		if u.DeletedAt != nil {
+			continue
+		}
+		user := u
+		if s.m.hasActiveToken(user.ID) {
+			user.Token.ID = 1
+		}
+		users = append(users, &user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].LastName < users[j].LastName
+	})
+
+	return users, nil
+}
+
+func (m *memoryDB) hasActiveToken(userID int) bool {
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.Expiry.After(time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	for _, u := range s.m.users {
+		if u.Email == email && u.DeletedAt == nil {
+			user := u
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryUserStore) GetUserById(ctx context.Context, id int) (*User, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	user, ok := s.m.liveUser(id)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+// liveUser returns the user with id unless there is none or they are in
+// the trash, the caller must hold the lock
+func (m *memoryDB) liveUser(id int) (User, bool) {
+	user, ok := m.users[id]
+	if !ok || user.DeletedAt != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+func (s *memoryUserStore) UpdateUser(ctx context.Context, u User) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user, ok := s.m.liveUser(u.ID)
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	if u.Version != 0 && u.Version != user.Version {
+		return 0, ErrEditConflict
+	}
+
+	if s.m.emailTaken(u.Email, u.ID) {
+		return 0, errMemoryUniqueViolation
+	}
+
+	user.Email = u.Email
+	user.FirstName = u.FirstName
+	user.LastName = u.LastName
+	user.Active = u.Active
+	user.Role = u.Role
+	user.UpdatedAt = time.Now()
+	user.Version++
+	s.m.users[u.ID] = user
+
+	return user.Version, nil
+}
+
+// emailTaken reports whether a user outside the trash other than exceptID
+// has email, like the partial unique index on users
+func (m *memoryDB) emailTaken(email string, exceptID int) bool {
+	for _, u := range m.users {
+		if u.Email == email && u.ID != exceptID && u.DeletedAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryUserStore) AddUser(ctx context.Context, user User) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
+	if err != nil {
+		return 0, err
+	}
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if s.m.emailTaken(user.Email, 0) {
+		return 0, errMemoryUniqueViolation
+	}
+
+	if user.Role == "" {
+		user.Role = RoleViewer
+	}
+
+	u := User{
+		ID:        s.m.id("users"),
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Password:  string(hashedPassword),
+		Active:    user.Active,
+		Role:      user.Role,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Version:   1,
+	}
+	s.m.users[u.ID] = u
+
+	return u.ID, nil
+}
+
+func (s *memoryUserStore) ResetUserPassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if user, ok := s.m.liveUser(id); ok {
+		user.Password = string(hashedPassword)
+		s.m.users[id] = user
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) DeleteUserById(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user, ok := s.m.liveUser(id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	user.DeletedAt = &now
+	user.Version++
+	s.m.users[id] = user
+
+	for rtID, rt := range s.m.refreshTokens {
+		if rt.UserID == id {
+			delete(s.m.refreshTokens, rtID)
+		}
+	}
+	for tokenID, t := range s.m.tokens {
+		if t.UserID == id {
+			delete(s.m.tokens, tokenID)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) TrashedUsers(ctx context.Context) ([]*User, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var users []*User
+	for _, u := range s.m.users {
+		if u.DeletedAt != nil {
+			user := u
+			user.Password = ""
+			users = append(users, &user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].DeletedAt.After(*users[j].DeletedAt)
+	})
+
+	return users, nil
+}
+
+func (s *memoryUserStore) RestoreUser(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user, ok := s.m.users[id]
+	if !ok || user.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+
+	if s.m.emailTaken(user.Email, id) {
+		return errMemoryUniqueViolation
+	}
+
+	user.DeletedAt = nil
+	user.UpdatedAt = time.Now()
+	user.Version++
+	s.m.users[id] = user
+
+	return nil
+}
+
+func (s *memoryUserStore) PurgeUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var purged int
+	for id, u := range s.m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(cutoff) {
+			s.m.dropUser(id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// dropUser deletes a user and everything of theirs, the way the foreign keys
+// cascade in postgres. The caller must hold the lock.
+func (m *memoryDB) dropUser(id int) {
+	delete(m.users, id)
+	delete(m.totp, id)
+	delete(m.recoveryCodes, id)
+	for ticketID, t := range m.mfaTickets {
+		if t.UserID == id {
+			delete(m.mfaTickets, ticketID)
+		}
+	}
+	for resetID, pr := range m.passwordResets {
+		if pr.UserID == id {
+			delete(m.passwordResets, resetID)
+		}
+	}
+	for rtID, rt := range m.refreshTokens {
+		if rt.UserID == id {
+			delete(m.refreshTokens, rtID)
+		}
+	}
+	for tokenID, t := range m.tokens {
+		if t.UserID == id {
+			delete(m.tokens, tokenID)
+		}
+	}
+}
+
+// Tokens
+
+func (s *memoryTokenStore) GetUserByToken(ctx context.Context, plainText string) (*Token, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	hash := hashToken(plainText)
+	for _, t := range s.m.tokens {
+		if bytes.Equal(t.TokenHash, hash) {
+			token := t
+			return &token, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryTokenStore) GetUserForToken(ctx context.Context, token Token) (*User, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	user, ok := s.m.liveUser(token.UserID)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+func (s *memoryTokenStore) GenerateToken(userID int, ttl time.Duration) (*Token, error) {
+	return generateToken(userID, ttl)
+}
+
+func (s *memoryTokenStore) AuthenticateToken(r *http.Request) (*User, error) {
+	return authenticateToken(s, r)
+}
+
+func (s *memoryTokenStore) DeleteByToken(ctx context.Context, plain string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	hash := hashToken(plain)
+	for id, t := range s.m.tokens {
+		if bytes.Equal(t.TokenHash, hash) {
+			delete(s.m.tokens, id)
+			s.m.revokeFamily(t.FamilyID)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryTokenStore) InsertToken(ctx context.Context, token Token, u User) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.users[token.UserID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	for id, t := range s.m.tokens {
+		if t.UserID == token.UserID && t.Expiry.Before(time.Now()) && !s.m.familyAlive(t.FamilyID) {
+			delete(s.m.tokens, id)
+		}
+	}
+
+	token.ID = s.m.id("tokens")
+	token.Token = ""
+	token.Email = u.Email
+	token.CreatedAt = time.Now()
+	token.UpdatedAt = time.Now()
+	token.LastUsedAt = time.Now()
+	s.m.tokens[token.ID] = token
+
+	return nil
+}
+
+func (s *memoryTokenStore) ValidToken(ctx context.Context, plain string) (bool, error) {
+	return validToken(ctx, s, plain)
+}
+
+func (s *memoryTokenStore) DeleteTokenForUser(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for tokenID, t := range s.m.tokens {
+		if t.UserID == id {
+			delete(s.m.tokens, tokenID)
+		}
+	}
+
+	for rtID, rt := range s.m.refreshTokens {
+		if rt.UserID == id {
+			delete(s.m.refreshTokens, rtID)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryTokenStore) SessionsForUser(ctx context.Context, userID int) ([]*Session, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	created := map[string]time.Time{}
+	for _, rt := range s.m.refreshTokens {
+		if first, ok := created[rt.FamilyID]; !ok || rt.CreatedAt.Before(first) {
+			created[rt.FamilyID] = rt.CreatedAt
+		}
+	}
+
+	var sessions []*Session
+	for _, rt := range s.m.refreshTokens {
+		if rt.UserID != userID || rt.UsedAt != nil || !rt.Expiry.After(time.Now()) {
+			continue
+		}
+
+		session := &Session{
+			ID:         rt.FamilyID,
+			UserID:     rt.UserID,
+			CreatedAt:  created[rt.FamilyID],
+			LastUsedAt: rt.CreatedAt,
+			Expiry:     rt.Expiry,
+		}
+		for _, t := range s.m.tokens {
+			if t.FamilyID == rt.FamilyID {
+				session.LastUsedAt = t.LastUsedAt
+				session.UserAgent = t.UserAgent
+				session.IPAddress = t.IPAddress
+			}
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+func (s *memoryTokenStore) DeleteSession(ctx context.Context, userID int, id string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	found := false
+	for _, rt := range s.m.refreshTokens {
+		if rt.FamilyID == id && rt.UserID == userID {
+			found = true
+		}
+	}
+	if !found || id == "" {
+		return sql.ErrNoRows
+	}
+
+	s.m.revokeFamily(id)
+
+	return nil
+}
+
+func (s *memoryTokenStore) TouchToken(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if t, ok := s.m.tokens[id]; ok {
+		t.LastUsedAt = time.Now()
+		s.m.tokens[id] = t
+	}
+
+	return nil
+}
+
+// Refresh tokens
+
+func (s *memoryRefreshTokenStore) GenerateRefreshToken(userID int, familyID string, ttl time.Duration) (*RefreshToken, error) {
+	return generateRefreshToken(userID, familyID, time.Now().Add(ttl))
+}
+
+func (s *memoryRefreshTokenStore) Insert(ctx context.Context, rt RefreshToken) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return s.m.insertRefreshToken(rt)
+}
+
+// insertRefreshToken stores rt by its hash, the caller must hold the lock
+func (m *memoryDB) insertRefreshToken(rt RefreshToken) error {
+	if _, ok := m.users[rt.UserID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	rt.ID = m.id("refresh_tokens")
+	rt.Token = ""
+	rt.CreatedAt = time.Now()
+	rt.UsedAt = nil
+	m.refreshTokens[rt.ID] = rt
+
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) GetByToken(ctx context.Context, plainText string) (*RefreshToken, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	hash := hashToken(plainText)
+	for _, rt := range s.m.refreshTokens {
+		if bytes.Equal(rt.TokenHash, hash) {
+			found := rt
+			return &found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryRefreshTokenStore) Rotate(ctx context.Context, used RefreshToken, access Token, next RefreshToken) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	current, ok := s.m.refreshTokens[used.ID]
+	if !ok || current.UsedAt != nil {
+		s.m.revokeFamily(used.FamilyID)
+		return ErrRefreshTokenReused
+	}
+
+	now := time.Now()
+	current.UsedAt = &now
+	s.m.refreshTokens[used.ID] = current
+
+	for id, t := range s.m.tokens {
+		if t.FamilyID == used.FamilyID {
+			delete(s.m.tokens, id)
+		}
+	}
+
+	access.ID = s.m.id("tokens")
+	access.Token = ""
+	access.FamilyID = used.FamilyID
+	access.CreatedAt = now
+	access.UpdatedAt = now
+	access.LastUsedAt = now
+	s.m.tokens[access.ID] = access
+
+	next.FamilyID = used.FamilyID
+	return s.m.insertRefreshToken(next)
+}
+
+func (s *memoryRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	s.m.revokeFamily(familyID)
+
+	return nil
+}
+
+// familyAlive reports whether a login can still be refreshed, the caller
+// must hold the lock
+func (m *memoryDB) familyAlive(familyID string) bool {
+	for _, rt := range m.refreshTokens {
+		if rt.FamilyID == familyID && rt.UsedAt == nil && rt.Expiry.After(time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeFamily drops every token of a login, the caller must hold the lock
+func (m *memoryDB) revokeFamily(familyID string) {
+	if familyID == "" {
+		return
+	}
+
+	for id, t := range m.tokens {
+		if t.FamilyID == familyID {
+			delete(m.tokens, id)
+		}
+	}
+
+	for id, rt := range m.refreshTokens {
+		if rt.FamilyID == familyID {
+			delete(m.refreshTokens, id)
+		}
+	}
+}
+
+// Password resets
+
+func (s *memoryPasswordResetStore) GeneratePasswordReset(userID int, ttl time.Duration) (*PasswordReset, error) {
+	return generatePasswordReset(userID, ttl)
+}
+
+func (s *memoryPasswordResetStore) Insert(ctx context.Context, pr PasswordReset) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.users[pr.UserID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	for id, old := range s.m.passwordResets {
+		if old.UserID == pr.UserID {
+			delete(s.m.passwordResets, id)
+		}
+	}
+
+	pr.ID = s.m.id("password_resets")
+	pr.Token = ""
+	pr.CreatedAt = time.Now()
+	pr.UsedAt = nil
+	s.m.passwordResets[pr.ID] = pr
+
+	return nil
+}
+
+func (s *memoryPasswordResetStore) Consume(ctx context.Context, plainText string) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	hash := hashToken(plainText)
+	for id, pr := range s.m.passwordResets {
+		if bytes.Equal(pr.TokenHash, hash) && pr.UsedAt == nil && pr.Expiry.After(time.Now()) {
+			now := time.Now()
+			pr.UsedAt = &now
+			s.m.passwordResets[id] = pr
+			return pr.UserID, nil
+		}
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+// Login attempts
+
+func (s *memoryLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempt, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	attempt, ok := s.m.loginAttempts[key]
+	if !ok {
+		return &LoginAttempt{Key: key}, nil
+	}
+
+	return &attempt, nil
+}
+
+func (s *memoryLoginAttemptStore) RecordFailure(ctx context.Context, key string, window time.Duration) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	now := time.Now()
+
+	attempt, ok := s.m.loginAttempts[key]
+	if !ok || attempt.LastFailureAt.Before(now.Add(-window)) {
+		attempt.Key = key
+		attempt.Failures = 0
+	}
+
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	s.m.loginAttempts[key] = attempt
+
+	return attempt.Failures, nil
+}
+
+func (s *memoryLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if attempt, ok := s.m.loginAttempts[key]; ok {
+		attempt.LockedUntil = &until
+		s.m.loginAttempts[key] = attempt
+	}
+
+	return nil
+}
+
+func (s *memoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	delete(s.m.loginAttempts, key)
+
+	return nil
+}
+
+func (s *memoryLoginAttemptStore) AllLocked(ctx context.Context) ([]*LoginAttempt, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var attempts []*LoginAttempt
+	for _, a := range s.m.loginAttempts {
+		if a.Locked(time.Now()) {
+			attempt := a
+			attempts = append(attempts, &attempt)
+		}
+	}
+
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].LockedUntil.After(*attempts[j].LockedUntil)
+	})
+
+	return attempts, nil
+}
+
+// Two-factor authentication
+
+func (s *memoryMFAStore) GetTOTP(ctx context.Context, userID int) (*TOTP, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	t, ok := s.m.totp[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &t, nil
+}
+
+func (s *memoryMFAStore) StartEnrollment(ctx context.Context, userID int, secret string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.users[userID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	if t, ok := s.m.totp[userID]; ok && t.Enabled {
+		return errors.New("two-factor authentication is already enabled")
+	}
+
+	s.m.totp[userID] = TOTP{UserID: userID, Secret: secret}
+
+	return nil
+}
+
+func (s *memoryMFAStore) Enable(ctx context.Context, userID int, step int64, recoveryCodes []string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	t, ok := s.m.totp[userID]
+	if !ok {
+		return nil
+	}
+
+	t.Enabled = true
+	t.LastStep = step
+	s.m.totp[userID] = t
+
+	var codes []recoveryCode
+	for _, code := range recoveryCodes {
+		codes = append(codes, recoveryCode{hash: hashToken(NormalizeRecoveryCode(code))})
+	}
+	s.m.recoveryCodes[userID] = codes
+
+	return nil
+}
+
+func (s *memoryMFAStore) Disable(ctx context.Context, userID int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	delete(s.m.totp, userID)
+	delete(s.m.recoveryCodes, userID)
+
+	return nil
+}
+
+func (s *memoryMFAStore) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	t, ok := s.m.totp[userID]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+
+	t.LastStep = step
+	s.m.totp[userID] = t
+
+	return true, nil
+}
+
+func (s *memoryMFAStore) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	hash := hashToken(NormalizeRecoveryCode(code))
+	for i, rc := range s.m.recoveryCodes[userID] {
+		if !rc.used && bytes.Equal(rc.hash, hash) {
+			s.m.recoveryCodes[userID][i].used = true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryMFAStore) GenerateTicket(userID int, ttl time.Duration) (*MFATicket, error) {
+	return generateMFATicket(userID, ttl)
+}
+
+func (s *memoryMFAStore) InsertTicket(ctx context.Context, ticket MFATicket) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.users[ticket.UserID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	for id, t := range s.m.mfaTickets {
+		if t.Expiry.Before(time.Now()) {
+			delete(s.m.mfaTickets, id)
+		}
+	}
+
+	ticket.ID = s.m.id("mfa_tickets")
+	ticket.Ticket = ""
+	s.m.mfaTickets[ticket.ID] = ticket
+
+	return nil
+}
+
+func (s *memoryMFAStore) GetTicket(ctx context.Context, plainText string) (*MFATicket, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	hash := hashToken(plainText)
+	for _, t := range s.m.mfaTickets {
+		if bytes.Equal(t.TicketHash, hash) && t.Expiry.After(time.Now()) {
+			ticket := t
+			return &ticket, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryMFAStore) DeleteTicket(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.mfaTickets[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(s.m.mfaTickets, id)
+
+	return nil
+}
+
+// Books
+
+func (s *memoryBookStore) GetAll(ctx context.Context) ([]*Book, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	return s.m.sortedBooks(), nil
+}
+
+func (s *memoryBookStore) GetAllPaginated(ctx context.Context, page, pageSize int) ([]*Book, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	books := s.m.sortedBooks()
+
+	offset := (page - 1) * pageSize
+	if offset < 0 || offset >= len(books) {
+		return nil, nil
+	}
+
+	end := offset + pageSize
+	if end > len(books) {
+		end = len(books)
+	}
+
+	return books[offset:end], nil
+}
+
+// GetAllFiltered applies f the way the postgres store does
+func (s *memoryBookStore) GetAllFiltered(ctx context.Context, f BookFilter) ([]*Book, int, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var books []*Book
+	for _, book := range s.m.sortedBooks() {
+		if memoryBookMatches(book, f) {
+			books = append(books, book)
+		}
+	}
+
+	sortKeys := f.Sort
+	if len(sortKeys) == 0 {
+		sortKeys = []string{"title"}
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		for _, key := range append(sortKeys, "id") {
+			c := compareBooks(books[i], books[j], strings.TrimPrefix(key, "-"))
+			if c == 0 {
+				continue
+			}
+			if strings.HasPrefix(key, "-") {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	total := len(books)
+
+	offset := (f.Page - 1) * f.PageSize
+	if offset < 0 || offset >= len(books) {
+		return nil, total, nil
+	}
+
+	end := offset + f.PageSize
+	if end > len(books) {
+		end = len(books)
+	}
+
+	return books[offset:end], total, nil
+}
+
+// memoryBookMatches reports whether book passes every filter in f
+func memoryBookMatches(book *Book, f BookFilter) bool {
+	if f.AuthorID != 0 && !book.creditsAuthor(f.AuthorID) {
+		return false
+	}
+	if f.YearMin != 0 && book.PublicationYear < f.YearMin {
+		return false
+	}
+	if f.YearMax != 0 && book.PublicationYear > f.YearMax {
+		return false
+	}
+	if !strings.HasPrefix(book.Slug, f.SlugPrefix) {
+		return false
+	}
+
+	if len(f.GenreIDs) == 0 {
+		return true
+	}
+
+	for _, want := range f.GenreIDs {
+		for _, id := range book.GenreIDs {
+			if id == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// creditsAuthor reports whether authorID is one of the book's contributors
+func (b *Book) creditsAuthor(authorID int) bool {
+	for _, c := range b.Contributors {
+		if c.AuthorID == authorID {
+			return true
+		}
+	}
+	return false
+}
+
+// contributorNames returns the names of everyone credited on the book
+func (b *Book) contributorNames() string {
+	var names []string
+	for _, c := range b.Contributors {
+		names = append(names, c.AuthorName)
+	}
+	return strings.Join(names, " ")
+}
+
+// compareBooks orders two books by one of BookSortKeys
+func compareBooks(a, b *Book, key string) int {
+	switch key {
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "author":
+		return strings.Compare(a.Author.AuthorName, b.Author.AuthorName)
+	case "publication_year":
+		return a.PublicationYear - b.PublicationYear
+	case "created_at":
+		return compareTimes(a.CreatedAt, b.CreatedAt)
+	case "updated_at":
+		return compareTimes(a.UpdatedAt, b.UpdatedAt)
+	default:
+		return a.ID - b.ID
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortedBooks returns every book not in the trash ordered by title, the caller
+// must hold the lock
+func (m *memoryDB) sortedBooks() []*Book {
+	var books []*Book
+	for id, b := range m.books {
+		if b.DeletedAt == nil {
+			books = append(books, m.loadBook(id))
+		}
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].Title < books[j].Title
+	})
+
+	return books
+}
+
+// loadBook returns a copy of a book with its author and genres filled in
+func (m *memoryDB) loadBook(id int) *Book {
+	book := m.books[id]
+	book.Author = m.authors[book.AuthorID]
+	book.Author.Bio = ""
+	book.Author.Photo = ""
+	book.Author.Photos = nil
+	if book.Covers == nil {
+		book.Covers = CoverSet{}
+	}
+	book.Genres = nil
+	book.GenreIDs = nil
+
+	for _, genreID := range m.bookGenres[id] {
+		book.Genres = append(book.Genres, m.genres[genreID])
+	}
+
+	sort.Slice(book.Genres, func(i, j int) bool {
+		return book.Genres[i].GenreName < book.Genres[j].GenreName
+	})
+
+	for _, genre := range book.Genres {
+		book.GenreIDs = append(book.GenreIDs, genre.ID)
+	}
+
+	for _, c := range m.contributors[id] {
+		c.AuthorName = m.authors[c.AuthorID].AuthorName
+		c.Slug = m.authors[c.AuthorID].Slug
+		book.Contributors = append(book.Contributors, c)
+	}
+
+	return &book
+}
+
+func (s *memoryBookStore) GetOneById(ctx context.Context, id int) (*Book, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	if b, ok := s.m.books[id]; !ok || b.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return s.m.loadBook(id), nil
+}
+
+func (s *memoryBookStore) GetOneBySlug(ctx context.Context, slug string) (*Book, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	for id, b := range s.m.books {
+		if b.Slug == slug && b.DeletedAt == nil {
+			return s.m.loadBook(id), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryBookStore) CurrentSlug(ctx context.Context, oldSlug string) (string, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	id, ok := s.m.bookSlugs[oldSlug]
+	if !ok || s.m.books[id].DeletedAt != nil {
+		return "", sql.ErrNoRows
+	}
+
+	return s.m.books[id].Slug, nil
+}
+
+// bookSlug picks a slug no other book has or had, like the postgres store
+func (m *memoryDB) bookSlug(title string, bookID int) string {
+	taken := map[string]bool{}
+	for id, b := range m.books {
+		if id != bookID {
+			taken[b.Slug] = true
+		}
+	}
+	for slug, id := range m.bookSlugs {
+		if id != bookID {
+			taken[slug] = true
+		}
+	}
+
+	return freeSlug(baseSlug(title), taken)
+}
+
+func (s *memoryBookStore) NextID(ctx context.Context) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return s.m.id("books"), nil
+}
+
+func (s *memoryBookStore) Insert(ctx context.Context, book Book) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	contributors, err := normalizeContributors(&book)
+	if err != nil {
+		return 0, err
+	}
+	book.Contributors = contributors
+
+	if _, ok := s.m.books[book.ID]; ok && book.ID != 0 {
+		return 0, errMemoryUniqueViolation
+	}
+
+	book.Slug = s.m.bookSlug(book.Title, 0)
+	if err := s.m.checkBook(book, 0); err != nil {
+		return 0, err
+	}
+
+	if book.ID == 0 {
+		book.ID = s.m.id("books")
+	}
+	book.CreatedAt = time.Now()
+	book.UpdatedAt = time.Now()
+	book.Version = 1
+	s.m.storeBook(book)
+	s.m.recordRevision(ctx, book.ID, RevisionCreate)
+
+	return book.ID, nil
+}
+
+func (s *memoryBookStore) Update(ctx context.Context, b Book) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if err := s.m.updateBook(b); err != nil {
+		return err
+	}
+
+	s.m.recordRevision(ctx, b.ID, RevisionUpdate)
+
+	return nil
+}
+
+// updateBook makes the changes of Update, the caller must hold the lock
+func (m *memoryDB) updateBook(b Book) error {
+	existing, ok := m.books[b.ID]
+	if !ok || existing.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	if b.Version != 0 && b.Version != existing.Version {
+		return ErrEditConflict
+	}
+
+	if b.Contributors == nil {
+		b.Contributors = []Contributor{}
+		for _, c := range m.contributors[b.ID] {
+			if c.Position > 0 {
+				b.Contributors = append(b.Contributors, c)
+			}
+		}
+	}
+
+	contributors, err := normalizeContributors(&b)
+	if err != nil {
+		return err
+	}
+	b.Contributors = contributors
+
+	b.Slug = m.bookSlug(b.Title, b.ID)
+	if err := m.checkBook(b, b.ID); err != nil {
+		return err
+	}
+
+	if existing.Slug != b.Slug {
+		m.bookSlugs[existing.Slug] = b.ID
+		delete(m.bookSlugs, b.Slug)
+	}
+
+	b.CreatedAt = existing.CreatedAt
+	b.UpdatedAt = time.Now()
+	b.Version = existing.Version + 1
+	if b.Cover == "" {
+		b.Cover = existing.Cover
+		b.Covers = existing.Covers
+	}
+	if len(b.GenreIDs) == 0 {
+		b.GenreIDs = m.bookGenres[b.ID]
+	}
+	m.storeBook(b)
+
+	return nil
+}
+
+func (s *memoryBookStore) SetCover(ctx context.Context, id int, cover string, covers CoverSet, version int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	book, ok := s.m.books[id]
+	if !ok || book.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	if version != 0 && version != book.Version {
+		return ErrEditConflict
+	}
+
+	book.Cover = cover
+	book.Covers = covers
+	book.UpdatedAt = time.Now()
+	book.Version++
+	s.m.books[id] = book
+	s.m.recordRevision(ctx, id, RevisionCover)
+
+	return nil
+}
+
+// checkBook enforces the constraints postgres has on the books table
+func (m *memoryDB) checkBook(book Book, exceptID int) error {
+	if _, ok := m.authors[book.AuthorID]; !ok {
+		return errMemoryForeignKey
+	}
+
+	for id, b := range m.books {
+		if b.Slug == book.Slug && id != exceptID {
+			return errMemoryUniqueViolation
+		}
+	}
+
+	for _, genreID := range book.GenreIDs {
+		if _, ok := m.genres[genreID]; !ok {
+			return errMemoryForeignKey
+		}
+	}
+
+	for _, c := range book.Contributors {
+		if _, ok := m.authors[c.AuthorID]; !ok {
+			return errMemoryForeignKey
+		}
+	}
+
+	return nil
+}
+
+// storeBook saves the bare book row, its genre ids and its contributors
+func (m *memoryDB) storeBook(book Book) {
+	m.bookGenres[book.ID] = append([]int(nil), book.GenreIDs...)
+	m.contributors[book.ID] = append([]Contributor(nil), book.Contributors...)
+
+	book.Author = Author{}
+	book.Genres = nil
+	book.GenreIDs = nil
+	book.Contributors = nil
+	m.books[book.ID] = book
+}
+
+func (s *memoryBookStore) DeleteByID(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	book, ok := s.m.books[id]
+	if !ok || book.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	book.DeletedAt = &now
+	book.Version++
+	s.m.books[id] = book
+	s.m.recordRevision(ctx, id, RevisionDelete)
+
+	return nil
+}
+
+func (s *memoryBookStore) Trashed(ctx context.Context) ([]*Book, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var books []*Book
+	for id, b := range s.m.books {
+		if b.DeletedAt != nil {
+			books = append(books, s.m.loadBook(id))
+		}
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].DeletedAt.After(*books[j].DeletedAt)
+	})
+
+	return books, nil
+}
+
+func (s *memoryBookStore) Restore(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	book, ok := s.m.books[id]
+	if !ok || book.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+
+	book.DeletedAt = nil
+	book.UpdatedAt = time.Now()
+	book.Version++
+	s.m.books[id] = book
+	s.m.recordRevision(ctx, id, RevisionRestore)
+
+	return nil
+}
+
+func (s *memoryBookStore) Purge(ctx context.Context, cutoff time.Time) ([]*Book, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var purged []*Book
+	for id, b := range s.m.books {
+		if b.DeletedAt == nil || !b.DeletedAt.Before(cutoff) {
+			continue
+		}
+
+		purged = append(purged, &Book{ID: b.ID, Title: b.Title, Cover: b.Cover, Covers: b.Covers})
+
+		delete(s.m.books, id)
+		delete(s.m.bookGenres, id)
+		delete(s.m.contributors, id)
+		delete(s.m.revisions, id)
+		for slug, bookID := range s.m.bookSlugs {
+			if bookID == id {
+				delete(s.m.bookSlugs, slug)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// recordRevision keeps the state of a book as its next revision, the caller
+// must hold the lock
+func (m *memoryDB) recordRevision(ctx context.Context, bookID int, action string) {
+	book := m.books[bookID]
+
+	snap := BookSnapshot{
+		Title:           book.Title,
+		AuthorID:        book.AuthorID,
+		PublicationYear: book.PublicationYear,
+		Slug:            book.Slug,
+		Description:     book.Description,
+		Cover:           book.Cover,
+		Covers:          book.Covers,
+		GenreIDs:        append([]int{}, m.bookGenres[bookID]...),
+		Contributors:    []SnapshotCredit{},
+	}
+	if snap.Covers == nil {
+		snap.Covers = CoverSet{}
+	}
+	sort.Ints(snap.GenreIDs)
+
+	for _, c := range m.contributors[bookID] {
+		snap.Contributors = append(snap.Contributors, SnapshotCredit{AuthorID: c.AuthorID, Role: c.Role, Position: c.Position})
+	}
+	sort.Slice(snap.Contributors, func(i, j int) bool {
+		return snap.Contributors[i].Position < snap.Contributors[j].Position
+	})
+
+	m.revisions[bookID] = append(m.revisions[bookID], BookRevision{
+		ID:        m.id("book_revisions"),
+		BookID:    bookID,
+		Revision:  len(m.revisions[bookID]) + 1,
+		EditorID:  editorID(ctx),
+		Action:    action,
+		Snapshot:  snap,
+		CreatedAt: time.Now(),
+	})
+}
+
+// loadRevision returns a copy of a revision with its editor filled in
+func (m *memoryDB) loadRevision(rev BookRevision) *BookRevision {
+	if rev.EditorID != nil {
+		rev.Editor = m.users[*rev.EditorID].Email
+	}
+	return &rev
+}
+
+func (s *memoryBookStore) Revisions(ctx context.Context, bookID int) ([]*BookRevision, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var revisions []*BookRevision
+	for i := len(s.m.revisions[bookID]) - 1; i >= 0; i-- {
+		revisions = append(revisions, s.m.loadRevision(s.m.revisions[bookID][i]))
+	}
+
+	return revisions, nil
+}
+
+func (s *memoryBookStore) Revision(ctx context.Context, bookID, revision int) (*BookRevision, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	revisions := s.m.revisions[bookID]
+	if revision < 1 || revision > len(revisions) {
+		return nil, sql.ErrNoRows
+	}
+
+	return s.m.loadRevision(revisions[revision-1]), nil
+}
+
+func (s *memoryBookStore) Revert(ctx context.Context, bookID, revision, version int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	revisions := s.m.revisions[bookID]
+	if revision < 1 || revision > len(revisions) {
+		return sql.ErrNoRows
+	}
+
+	snap := revisions[revision-1].Snapshot
+	book := snap.book(bookID)
+	book.Version = version
+	book.GenreIDs = s.m.liveGenres(snap.GenreIDs)
+	if err := s.m.updateBook(book); err != nil {
+		return err
+	}
+
+	if len(book.GenreIDs) == 0 {
+		s.m.bookGenres[bookID] = nil
+	}
+
+	s.m.recordRevision(ctx, bookID, RevisionRevert)
+
+	return nil
+}
+
+// Search ranks books the way the postgres store weighs them, matching whole
+// words without stemming
+func (s *memoryBookStore) Search(ctx context.Context, q string, limit int) ([]*BookSearchResult, error) {
+	terms := parseSearch(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var results []*BookSearchResult
+
+	for _, book := range s.m.sortedBooks() {
+		fields := []struct {
+			text   string
+			weight float64
+			spans  []textWord
+		}{
+			{text: book.Title, weight: 1},
+			{text: book.contributorNames(), weight: 0.4},
+			{text: book.Description, weight: 0.2},
+		}
+
+		var rank float64
+		matched := true
+		for _, t := range terms {
+			found := false
+			for i := range fields {
+				spans := matchTerm(splitWords(fields[i].text), t)
+				if len(spans) > 0 {
+					found = true
+					rank += fields[i].weight * float64(len(spans))
+					fields[i].spans = append(fields[i].spans, spans...)
+				}
+			}
+			if !found {
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		results = append(results, &BookSearchResult{
+			Book: book,
+			Rank: rank,
+			Highlights: SearchHighlights{
+				Title:       highlightWords(book.Title, fields[0].spans),
+				Description: highlightWords(book.Description, fields[2].spans),
+			},
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank > results[j].Rank
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// textWord is a lowercased word and where it sits in the original text
+type textWord struct {
+	word       string
+	start, end int
+}
+
+// splitWords breaks text into words the same way parseSearch does
+func splitWords(text string) []textWord {
+	var words []textWord
+
+	start := -1
+	for i, r := range text + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			words = append(words, textWord{word: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+
+	return words
+}
+
+// matchTerm returns every word of text that is part of a match for t
+func matchTerm(words []textWord, t searchTerm) []textWord {
+	var matched []textWord
+
+	for i := 0; i+len(t.words) <= len(words); i++ {
+		ok := true
+		for j, w := range t.words {
+			candidate := words[i+j].word
+			last := j == len(t.words)-1
+			if candidate != w && !(last && t.prefix && strings.HasPrefix(candidate, w)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, words[i:i+len(t.words)]...)
+		}
+	}
+
+	return matched
+}
+
+// highlightWords wraps each of the given words of text in <mark> tags and
+// escapes the rest, like ts_headline over escapeHTML does
+func highlightWords(text string, words []textWord) string {
+	sort.Slice(words, func(i, j int) bool {
+		return words[i].start < words[j].start
+	})
+
+	var b strings.Builder
+	pos := 0
+	for _, w := range words {
+		if w.start < pos {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:w.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[w.start:w.end]) + "</mark>")
+		pos = w.end
+	}
+	b.WriteString(html.EscapeString(text[pos:]))
+
+	return b.String()
+}
+
+// Authors
+
+func (s *memoryAuthorStore) All(ctx context.Context) ([]*Author, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var authors []*Author
+	for _, a := range s.m.authors {
+		author := a
+		authors = append(authors, &author)
+	}
+
+	sort.Slice(authors, func(i, j int) bool {
+		return authors[i].AuthorName < authors[j].AuthorName
+	})
+
+	return authors, nil
+}
+
+func (s *memoryAuthorStore) GetOneById(ctx context.Context, id int) (*Author, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	author, ok := s.m.authors[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &author, nil
+}
+
+func (s *memoryAuthorStore) GetOneBySlug(ctx context.Context, slug string) (*Author, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	for _, a := range s.m.authors {
+		if a.Slug == slug {
+			author := a
+			return &author, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryAuthorStore) NextID(ctx context.Context) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return s.m.id("authors"), nil
+}
+
+func (s *memoryAuthorStore) Insert(ctx context.Context, author Author) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if author.ID == 0 {
+		author.ID = s.m.id("authors")
+	} else if _, ok := s.m.authors[author.ID]; ok {
+		return 0, errMemoryUniqueViolation
+	}
+
+	author.Slug = s.m.authorSlug(author.AuthorName, 0)
+	author.CreatedAt = time.Now()
+	author.UpdatedAt = time.Now()
+	s.m.authors[author.ID] = author
+
+	return author.ID, nil
+}
+
+func (s *memoryAuthorStore) Update(ctx context.Context, author Author) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	existing, ok := s.m.authors[author.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	author.Slug = s.m.authorSlug(author.AuthorName, author.ID)
+
+	if author.Photo == "" {
+		author.Photo = existing.Photo
+		author.Photos = existing.Photos
+	}
+	author.CreatedAt = existing.CreatedAt
+	author.UpdatedAt = time.Now()
+	s.m.authors[author.ID] = author
+
+	return nil
+}
+
+func (s *memoryAuthorStore) SetPhoto(ctx context.Context, id int, photo string, photos CoverSet) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	author, ok := s.m.authors[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	author.Photo = photo
+	author.Photos = photos
+	author.UpdatedAt = time.Now()
+	s.m.authors[id] = author
+
+	return nil
+}
+
+func (s *memoryAuthorStore) DeleteByID(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.authors[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	for _, contributors := range s.m.contributors {
+		for _, c := range contributors {
+			if c.AuthorID == id {
+				return ErrAuthorHasBooks
+			}
+		}
+	}
+
+	delete(s.m.authors, id)
+
+	return nil
+}
+
+// authorSlug picks a slug no other author has, like the postgres store
+func (m *memoryDB) authorSlug(name string, authorID int) string {
+	taken := map[string]bool{}
+	for id, a := range m.authors {
+		if id != authorID {
+			taken[a.Slug] = true
+		}
+	}
+
+	return freeSlug(slugify.Slugify(name), taken)
+}
+
+// Genres
+
+func (s *memoryGenreStore) All(ctx context.Context) ([]*GenreWithCount, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	counts := map[int]int{}
+	for bookID, genreIDs := range s.m.bookGenres {
+		if s.m.books[bookID].DeletedAt != nil {
+			continue
+		}
+		for _, id := range genreIDs {
+			counts[id]++
+		}
+	}
+
+	var genres []*GenreWithCount
+	for id, g := range s.m.genres {
+		genres = append(genres, &GenreWithCount{Genre: g, BookCount: counts[id]})
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].GenreName < genres[j].GenreName
+	})
+
+	return genres, nil
+}
+
+func (s *memoryGenreStore) GetOneById(ctx context.Context, id int) (*Genre, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	genre, ok := s.m.genres[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &genre, nil
+}
+
+func (s *memoryGenreStore) GetOneBySlug(ctx context.Context, slug string) (*Genre, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	for _, g := range s.m.genres {
+		if g.Slug == slug {
+			genre := g
+			return &genre, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryGenreStore) Insert(ctx context.Context, genre Genre) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	genre.ID = s.m.id("genres")
+	genre.Slug = s.m.genreSlug(genre.GenreName, genre.ID)
+	genre.CreatedAt = time.Now()
+	genre.UpdatedAt = time.Now()
+	s.m.genres[genre.ID] = genre
+
+	return genre.ID, nil
+}
+
+func (s *memoryGenreStore) Update(ctx context.Context, genre Genre) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	existing, ok := s.m.genres[genre.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	genre.Slug = s.m.genreSlug(genre.GenreName, genre.ID)
+	genre.CreatedAt = existing.CreatedAt
+	genre.UpdatedAt = time.Now()
+	s.m.genres[genre.ID] = genre
+
+	return nil
+}
+
+func (s *memoryGenreStore) DeleteByID(ctx context.Context, id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if _, ok := s.m.genres[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	s.m.replaceGenre(ctx, id, 0)
+	delete(s.m.genres, id)
+
+	for from, into := range s.m.genreMerges {
+		if into == id {
+			delete(s.m.genreMerges, from)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryGenreStore) Merge(ctx context.Context, fromID, intoID int) error {
+	if fromID == intoID {
+		return ErrMergeIntoSelf
+	}
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	_, fromOK := s.m.genres[fromID]
+	_, intoOK := s.m.genres[intoID]
+	if !fromOK || !intoOK {
+		return sql.ErrNoRows
+	}
+
+	s.m.replaceGenre(ctx, fromID, intoID)
+	delete(s.m.genres, fromID)
+
+	for from, into := range s.m.genreMerges {
+		if into == fromID {
+			s.m.genreMerges[from] = intoID
+		}
+	}
+	s.m.genreMerges[fromID] = intoID
+
+	return nil
+}
+
+// liveGenres follows merged genres and drops deleted ones like the postgres
+// store, the caller must hold the lock
+func (m *memoryDB) liveGenres(ids []int) []int {
+	live := []int{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		if into, ok := m.genreMerges[id]; ok {
+			id = into
+		}
+		if _, ok := m.genres[id]; ok && !seen[id] {
+			seen[id] = true
+			live = append(live, id)
+		}
+	}
+
+	sort.Ints(live)
+	return live
+}
+
+// replaceGenre swaps genre fromID for intoID on every book, or just removes
+// it when intoID is 0, and records a new version and revision of each book
+// it changes like the postgres store
+func (m *memoryDB) replaceGenre(ctx context.Context, fromID, intoID int) {
+	for bookID, genreIDs := range m.bookGenres {
+		var kept []int
+		has := map[int]bool{}
+		changed := false
+		for _, id := range genreIDs {
+			if id == fromID {
+				id = intoID
+				changed = true
+			}
+			if id != 0 && !has[id] {
+				has[id] = true
+				kept = append(kept, id)
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		m.bookGenres[bookID] = kept
+
+		book := m.books[bookID]
+		book.Version++
+		book.UpdatedAt = time.Now()
+		m.books[bookID] = book
+		m.recordRevision(ctx, bookID, RevisionGenres)
+	}
+}
+
+// genreSlug picks a slug no other genre has, like the postgres store
+func (m *memoryDB) genreSlug(name string, genreID int) string {
+	taken := map[string]bool{}
+	for id, g := range m.genres {
+		if id != genreID {
+			taken[g.Slug] = true
+		}
+	}
+
+	return freeSlug(slugify.Slugify(name), taken)
+}
+
+func (s *memoryAuditStore) Record(ctx context.Context, entry AuditEntry) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	entry.ID = s.m.id("audit_log")
+	entry.CreatedAt = time.Now()
+	s.m.auditLog = append(s.m.auditLog, entry)
+
+	return nil
+}
+
+func (s *memoryAuditStore) List(ctx context.Context, f AuditFilter) ([]*AuditEntry, int, error) {
+	s.m.mu.RLock()
+	defer s.m.mu.RUnlock()
+
+	var matched []*AuditEntry
+	for i := len(s.m.auditLog) - 1; i >= 0; i-- {
+		if entry := s.m.auditLog[i]; f.matches(entry) {
+			matched = append(matched, &entry)
+		}
+	}
+
+	start := (f.Page - 1) * f.PageSize
+	if start >= len(matched) {
+		return nil, len(matched), nil
+	}
+	end := start + f.PageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	return matched[start:end], len(matched), nil
+}
+
+func (s *memoryAuditStore) Export(ctx context.Context, f AuditFilter, fn func(*AuditEntry) error) error {
+	s.m.mu.RLock()
+	entries := append([]AuditEntry(nil), s.m.auditLog...)
+	s.m.mu.RUnlock()
+
+	for _, entry := range entries {
+		if !f.matches(entry) {
+			continue
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewMemoryDemo returns in-memory models seeded with a demo admin user and a
+// small catalog matching the covers shipped in static/covers
+func NewMemoryDemo() Models {
+	ctx := context.Background()
+	m := newMemoryDB()
+	models := newMemoryModels(m)
+
+	_, _ = models.User.AddUser(ctx, User{
+		Email:     DemoEmail,
+		FirstName: "Admin",
+		LastName:  "User",
+		Password:  DemoPassword,
+		Active:    1,
+		Role:      RoleAdmin,
+	})
+
+	_, _ = models.Author.Insert(ctx, Author{
+		AuthorName: "Stephen King",
+		Bio:        "Stephen King is the author of more than sixty books, all of them worldwide bestsellers.",
+	})
+
+	for _, name := range []string{"Horror", "Fantasy", "Thriller", "Science Fiction"} {
+		_, _ = models.Genre.Insert(ctx, Genre{GenreName: name})
+	}
+
+	books := []struct {
+		title  string
+		year   int
+		genres []int
+		cover  string
+	}{
+		{"Salem's Lot", 1975, []int{1}, "salems-lot.jpg"},
+		{"The Shining", 1977, []int{1, 3}, "the-shining.jpg"},
+		{"The Stand", 1978, []int{1, 2, 4}, "the-stand.jpg"},
+		{"The Dead Zone", 1979, []int{3, 4}, "the-dead-zone.jpg"},
+		{"The Gunslinger", 1982, []int{2}, "the-gunslinger.jpg"},
+		{"It", 1986, []int{1}, "it.jpg"},
+	}
+
+	for _, b := range books {
+		_, _ = models.Book.Insert(ctx, Book{
+			Title:           b.title,
+			AuthorID:        1,
+			PublicationYear: b.year,
+			Description:     b.title + " by Stephen King.",
+			Cover:           b.cover,
+			GenreIDs:        b.genres,
+		})
+	}
+
+	return models
+}
+
+// credentials of the user created by NewMemoryDemo
+const (
+	DemoEmail    = "admin@example.com"
+	DemoPassword = "password"
+)
@@ -0,0 +1,277 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// TOTP is a user's authenticator app enrollment
+type TOTP struct {
+	UserID   int
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// MFATicket proves a user passed the password step of a login and may finish
+// it with a second factor
+type MFATicket struct {
+	ID         int       `json:"-"`
+	UserID     int       `json:"-"`
+	Ticket     string    `json:"ticket,omitempty"`
+	TicketHash []byte    `json:"-"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+type postgresMFAStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+// NormalizeRecoveryCode strips the formatting users may type around a code
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// GenerateRecoveryCodes returns n random one-time codes formatted as xxxxx-xxxxx
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	var codes []string
+
+	for i := 0; i < n; i++ {
+		random, err := randomString(8)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(random[:10])
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, nil
+}
+
+// generateMFATicket creates a random ticket for a user
+func generateMFATicket(userID int, ttl time.Duration) (*MFATicket, error) {
+	plain, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFATicket{
+		UserID:     userID,
+		Ticket:     plain,
+		TicketHash: hashToken(plain),
+		Expiry:     time.Now().Add(ttl),
+	}, nil
+}
+
+// GetTOTP returns the enrollment of a user, sql.ErrNoRows if they have none
+func (s *postgresMFAStore) GetTOTP(ctx context.Context, userID int) (*TOTP, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select user_id, secret, enabled, last_step from user_totp where user_id = $1`
+
+	var t TOTP
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Enabled, &t.LastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// StartEnrollment stores a new, not yet enabled secret for a user. It fails
+// if the user already has two-factor authentication enabled.
+func (s *postgresMFAStore) StartEnrollment(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `insert into user_totp (user_id, secret, enabled, last_step, created_at, updated_at)
+	values ($1, $2, false, 0, $3, $3)
+	on conflict (user_id) do update set secret = $2, last_step = 0, updated_at = $3
+	where user_totp.enabled = false`
+
+	result, err := s.db.ExecContext(ctx, stmt, userID, secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("two-factor authentication is already enabled")
+	}
+
+	return nil
+}
+
+// Enable turns on two-factor authentication for a user and replaces their
+// recovery codes with the given ones
+func (s *postgresMFAStore) Enable(ctx context.Context, userID int, step int64, recoveryCodes []string) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update user_totp set enabled = true, last_step = $1, updated_at = $2 where user_id = $3`
+	if _, err := tx.ExecContext(ctx, stmt, step, time.Now(), userID); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes stores the hashes of codes as the user's only recovery codes
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codes []string) error {
+	if _, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	stmt := `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, stmt, userID, hashToken(NormalizeRecoveryCode(code)), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Disable removes a user's enrollment and recovery codes
+func (s *postgresMFAStore) Disable(ctx context.Context, userID int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `with r as (delete from recovery_codes where user_id = $1)
+	delete from user_totp where user_id = $1`
+
+	_, err := s.db.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseStep records that the code for step was accepted. It returns false when
+// that step, or a later one, was already used, which means a replayed code.
+func (s *postgresMFAStore) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `update user_totp set last_step = $1 where user_id = $2 and last_step < $1`
+
+	result, err := s.db.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes, it returns false
+// if the code does not match an unused one
+func (s *postgresMFAStore) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := s.db.ExecContext(ctx, stmt, time.Now(), userID, hashToken(NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// GenerateTicket creates an mfa ticket valid for ttl, it is not saved
+func (s *postgresMFAStore) GenerateTicket(userID int, ttl time.Duration) (*MFATicket, error) {
+	return generateMFATicket(userID, ttl)
+}
+
+// InsertTicket saves an mfa ticket by its hash
+func (s *postgresMFAStore) InsertTicket(ctx context.Context, ticket MFATicket) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	// expired tickets of anyone are of no use, clear them out while here
+	stmt := `with old as (delete from mfa_tickets where expiry < $4)
+	insert into mfa_tickets (user_id, ticket_hash, created_at, expiry) values ($1, $2, $4, $3)`
+
+	_, err := s.db.ExecContext(ctx, stmt, ticket.UserID, ticket.TicketHash, ticket.Expiry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTicket returns the unexpired ticket matching plainText
+func (s *postgresMFAStore) GetTicket(ctx context.Context, plainText string) (*MFATicket, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select id, user_id, ticket_hash, expiry from mfa_tickets where ticket_hash = $1 and expiry > $2`
+
+	var ticket MFATicket
+	err := s.db.QueryRowContext(ctx, query, hashToken(plainText), time.Now()).Scan(
+		&ticket.ID,
+		&ticket.UserID,
+		&ticket.TicketHash,
+		&ticket.Expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ticket, nil
+}
+
+// DeleteTicket removes a ticket once it has been exchanged, it returns
+// sql.ErrNoRows if another request got to it first
+func (s *postgresMFAStore) DeleteTicket(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `delete from mfa_tickets where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
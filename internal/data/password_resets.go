@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PasswordReset is a single-use token emailed to a user who forgot their
+// password. Only its hash is stored.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	Token     string
+	TokenHash []byte
+	CreatedAt time.Time
+	Expiry    time.Time
+	UsedAt    *time.Time
+}
+
+type postgresPasswordResetStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+// generatePasswordReset creates a random reset token for a user
+func generatePasswordReset(userID int, ttl time.Duration) (*PasswordReset, error) {
+	plain, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordReset{
+		UserID:    userID,
+		Token:     plain,
+		TokenHash: hashToken(plain),
+		CreatedAt: time.Now(),
+		Expiry:    time.Now().Add(ttl),
+	}, nil
+}
+
+// GeneratePasswordReset creates a reset token valid for ttl, it is not saved
+func (s *postgresPasswordResetStore) GeneratePasswordReset(userID int, ttl time.Duration) (*PasswordReset, error) {
+	return generatePasswordReset(userID, ttl)
+}
+
+// Insert saves a reset token, any earlier unused token of the user stops working
+func (s *postgresPasswordResetStore) Insert(ctx context.Context, pr PasswordReset) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `with old as (delete from password_resets where user_id = $1)
+	insert into password_resets (user_id, token_hash, created_at, expiry) values ($1, $2, $3, $4)`
+
+	_, err := s.db.ExecContext(ctx, stmt, pr.UserID, pr.TokenHash, time.Now(), pr.Expiry)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Consume marks an unused, unexpired reset token as used and returns its
+// user id. It returns sql.ErrNoRows for any token that cannot be used.
+func (s *postgresPasswordResetStore) Consume(ctx context.Context, plainText string) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `update password_resets set used_at = $1
+	where token_hash = $2 and used_at is null and expiry > $1
+	returning user_id`
+
+	var userID int
+	err := s.db.QueryRowContext(ctx, stmt, time.Now(), hashToken(plainText)).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// exchanged is presented again. The whole family has been revoked by then.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// RefreshToken is a single-use token that can be exchanged for a new access
+// token. Every token rotated from the same login shares a FamilyID.
+type RefreshToken struct {
+	ID        int        `json:"-"`
+	UserID    int        `json:"-"`
+	FamilyID  string     `json:"-"`
+	Token     string     `json:"token,omitempty"`
+	TokenHash []byte     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	Expiry    time.Time  `json:"expiry"`
+	UsedAt    *time.Time `json:"-"`
+}
+
+// Session is one login of a user: every access and refresh token handed out
+// since it, which share a family. ID is the family id.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+}
+
+type postgresRefreshTokenStore struct {
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+// generateRefreshToken creates a random refresh token in a family, a new
+// family is started when familyID is empty
+func generateRefreshToken(userID int, familyID string, expiry time.Time) (*RefreshToken, error) {
+	if familyID == "" {
+		id, err := randomString(16)
+		if err != nil {
+			return nil, err
+		}
+		familyID = id
+	}
+
+	plain, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		Token:     plain,
+		TokenHash: hashToken(plain),
+		CreatedAt: time.Now(),
+		Expiry:    expiry,
+	}, nil
+}
+
+// randomString returns n random bytes encoded as unpadded base32
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// GenerateRefreshToken creates a refresh token valid for ttl, it is not saved
+func (s *postgresRefreshTokenStore) GenerateRefreshToken(userID int, familyID string, ttl time.Duration) (*RefreshToken, error) {
+	return generateRefreshToken(userID, familyID, time.Now().Add(ttl))
+}
+
+// Insert saves a refresh token by its hash
+func (s *postgresRefreshTokenStore) Insert(ctx context.Context, rt RefreshToken) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `insert into refresh_tokens (user_id, family_id, token_hash, created_at, expiry) values ($1, $2, $3, $4, $5)`
+
+	_, err := s.db.ExecContext(ctx, stmt, rt.UserID, rt.FamilyID, rt.TokenHash, time.Now(), rt.Expiry)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetByToken returns the refresh token matching plainText
+func (s *postgresRefreshTokenStore) GetByToken(ctx context.Context, plainText string) (*RefreshToken, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select id, user_id, family_id, token_hash, created_at, expiry, used_at from refresh_tokens where token_hash = $1`
+
+	var rt RefreshToken
+
+	err := s.db.QueryRowContext(ctx, query, hashToken(plainText)).Scan(
+		&rt.ID,
+		&rt.UserID,
+		&rt.FamilyID,
+		&rt.TokenHash,
+		&rt.CreatedAt,
+		&rt.Expiry,
+		&rt.UsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rt, nil
+}
+
+// Rotate marks used as spent and, in the same transaction, replaces the
+// family's access token with access and stores next. If used was already
+// spent the family is revoked and ErrRefreshTokenReused is returned.
+func (s *postgresRefreshTokenStore) Rotate(ctx context.Context, used RefreshToken, access Token, next RefreshToken) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update refresh_tokens set used_at = $1 where id = $2 and used_at is null`
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), used.ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		_ = tx.Rollback()
+		if err := s.RevokeFamily(ctx, used.FamilyID); err != nil {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+
+	stmt = `delete from tokens where family_id = $1`
+	if _, err := tx.ExecContext(ctx, stmt, used.FamilyID); err != nil {
+		return err
+	}
+
+	stmt = `insert into tokens (user_id, email, token_hash, created_at, updated_at, expiry, last_used_at, user_agent, ip_address,
+	family_id) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err = tx.ExecContext(ctx, stmt,
+		access.UserID,
+		access.Email,
+		access.TokenHash,
+		time.Now(),
+		time.Now(),
+		access.Expiry,
+		time.Now(),
+		access.UserAgent,
+		access.IPAddress,
+		used.FamilyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	stmt = `insert into refresh_tokens (user_id, family_id, token_hash, created_at, expiry) values ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, stmt, next.UserID, used.FamilyID, next.TokenHash, time.Now(), next.Expiry)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeFamily deletes every access and refresh token of a login
+func (s *postgresRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	stmt := `with t as (delete from tokens where family_id = $1)
+	delete from refresh_tokens where family_id = $1`
+
+	_, err := s.db.ExecContext(ctx, stmt, familyID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// what a revision records happening to a book
+const (
+	RevisionBaseline = "baseline"
+	RevisionCreate   = "create"
+	RevisionUpdate   = "update"
+	RevisionCover    = "cover"
+	RevisionDelete   = "delete"
+	RevisionRestore  = "restore"
+	RevisionRevert   = "revert"
+	// RevisionGenres is a genre of the book being merged into another or
+	// deleted
+	RevisionGenres = "genres"
+)
+
+// BookSnapshot is everything about a book a revision keeps
+type BookSnapshot struct {
+	Title           string           `json:"title"`
+	AuthorID        int              `json:"author_id"`
+	PublicationYear int              `json:"publication_year"`
+	Slug            string           `json:"slug"`
+	Description     string           `json:"description"`
+	Cover           string           `json:"cover"`
+	Covers          CoverSet         `json:"covers"`
+	GenreIDs        []int            `json:"genre_ids"`
+	Contributors    []SnapshotCredit `json:"contributors"`
+}
+
+// SnapshotCredit is a contributor as a snapshot keeps it, names are looked
+// up when a book is read so only who has which role is kept
+type SnapshotCredit struct {
+	AuthorID int    `json:"author_id"`
+	Role     string `json:"role"`
+	Position int    `json:"position"`
+}
+
+// BookRevision is the state of a book after one change. Revisions are
+// numbered per book from 1, EditorID is nil when the change was not made by
+// a logged in user, such as by a command.
+type BookRevision struct {
+	ID        int          `json:"id"`
+	BookID    int          `json:"book_id"`
+	Revision  int          `json:"revision"`
+	EditorID  *int         `json:"editor_id"`
+	Editor    string       `json:"editor,omitempty"`
+	Action    string       `json:"action"`
+	Snapshot  BookSnapshot `json:"snapshot"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// FieldChange is one field that differs between two revisions
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// snapshotFields lists the fields of BookSnapshot in the order diffs report
+// them
+var snapshotFields = []string{
+	"title",
+	"author_id",
+	"publication_year",
+	"slug",
+	"description",
+	"cover",
+	"covers",
+	"genre_ids",
+	"contributors",
+}
+
+// DiffSnapshots returns every field that changed from one snapshot to the
+// other
+func DiffSnapshots(from, to BookSnapshot) ([]FieldChange, error) {
+	before, err := snapshotMap(from)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := snapshotMap(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FieldChange{}
+	for _, field := range snapshotFields {
+		if string(before[field]) != string(after[field]) {
+			changes = append(changes, FieldChange{Field: field, From: before[field], To: after[field]})
+		}
+	}
+
+	return changes, nil
+}
+
+// snapshotMap encodes each field of a snapshot on its own so they can be
+// compared
+func snapshotMap(s BookSnapshot) (map[string]json.RawMessage, error) {
+	if s.GenreIDs == nil {
+		s.GenreIDs = []int{}
+	}
+
+	if s.Contributors == nil {
+		s.Contributors = []SnapshotCredit{}
+	}
+
+	if s.Covers == nil {
+		s.Covers = CoverSet{}
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+type editorContextKey struct{}
+
+// WithEditor returns a context that credits book changes made with it to
+// the user with userID
+func WithEditor(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, editorContextKey{}, userID)
+}
+
+// editorID returns the user WithEditor stored on ctx, or nil
+func editorID(ctx context.Context) *int {
+	id, ok := ctx.Value(editorContextKey{}).(int)
+	if !ok {
+		return nil
+	}
+	return &id
+}
+
+// snapshotBook reads the current state of a book and locks its row until tx
+// ends
+func snapshotBook(ctx context.Context, tx *sql.Tx, bookID int) (BookSnapshot, error) {
+	var snap BookSnapshot
+
+	query := `select title, author_id, publication_year, slug, description, cover, covers
+		from books where id = $1 for update`
+
+	err := tx.QueryRowContext(ctx, query, bookID).Scan(
+		&snap.Title,
+		&snap.AuthorID,
+		&snap.PublicationYear,
+		&snap.Slug,
+		&snap.Description,
+		&snap.Cover,
+		&snap.Covers)
+	if err != nil {
+		return snap, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `select genre_id from books_genres where book_id = $1 order by genre_id`, bookID)
+	if err != nil {
+		return snap, err
+	}
+	defer rows.Close()
+
+	snap.GenreIDs = []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return snap, err
+		}
+		snap.GenreIDs = append(snap.GenreIDs, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return snap, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `select author_id, role, position from book_contributors where book_id = $1 order by position`, bookID)
+	if err != nil {
+		return snap, err
+	}
+	defer rows.Close()
+
+	snap.Contributors = []SnapshotCredit{}
+	for rows.Next() {
+		var c SnapshotCredit
+		if err := rows.Scan(&c.AuthorID, &c.Role, &c.Position); err != nil {
+			return snap, err
+		}
+		snap.Contributors = append(snap.Contributors, c)
+	}
+
+	return snap, rows.Err()
+}
+
+// recordRevision saves the state of a book after a change made in tx as its
+// next revision, credited to the editor on ctx
+func recordRevision(ctx context.Context, tx *sql.Tx, bookID int, action string) error {
+	snap, err := snapshotBook(ctx, tx, bookID)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into book_revisions (book_id, revision, editor_id, action, snapshot, created_at)
+		select $1, coalesce(max(revision), 0) + 1, $2, $3, $4, $5 from book_revisions where book_id = $1`
+
+	_, err = tx.ExecContext(ctx, stmt, bookID, editorID(ctx), action, string(b), time.Now())
+	return err
+}
+
+const revisionColumns = `r.id, r.book_id, r.revision, r.editor_id, coalesce(u.email, ''), r.action, r.snapshot, r.created_at`
+
+func scanRevision(row rowScanner) (*BookRevision, error) {
+	var rev BookRevision
+	var snapshot []byte
+
+	err := row.Scan(
+		&rev.ID,
+		&rev.BookID,
+		&rev.Revision,
+		&rev.EditorID,
+		&rev.Editor,
+		&rev.Action,
+		&snapshot,
+		&rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(snapshot, &rev.Snapshot); err != nil {
+		return nil, err
+	}
+
+	return &rev, nil
+}
+
+// Revisions returns every revision of a book, newest first
+func (s *postgresBookStore) Revisions(ctx context.Context, bookID int) ([]*BookRevision, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + revisionColumns + `
+			from book_revisions r
+			left join users u on (u.id = r.editor_id)
+			where r.book_id = $1
+			order by r.revision desc`
+
+	rows, err := s.db.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*BookRevision
+
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+// Revision returns one revision of a book
+func (s *postgresBookStore) Revision(ctx context.Context, bookID, revision int) (*BookRevision, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + revisionColumns + `
+			from book_revisions r
+			left join users u on (u.id = r.editor_id)
+			where r.book_id = $1 and r.revision = $2`
+
+	return scanRevision(s.db.QueryRowContext(ctx, query, bookID, revision))
+}
+
+// Revert puts a book back the way it was at revision, and records that as a
+// new revision. The cover is left alone, since the files of covers that
+// have been replaced are gone, and genres merged or deleted since are
+// followed or dropped. A non-zero version must be the book's current one, or
+// ErrEditConflict is returned.
+func (s *postgresBookStore) Revert(ctx context.Context, bookID, revision, version int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var raw []byte
+	err = tx.QueryRowContext(ctx, `select snapshot from book_revisions where book_id = $1 and revision = $2`,
+		bookID, revision).Scan(&raw)
+	if err != nil {
+		return err
+	}
+
+	var snap BookSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return err
+	}
+
+	book := snap.book(bookID)
+	book.Version = version
+	book.GenreIDs, err = liveGenres(ctx, tx, snap.GenreIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := s.update(ctx, tx, book); err != nil {
+		return err
+	}
+
+	// update keeps the genres when none are given, a revision without any
+	// must clear them
+	if len(book.GenreIDs) == 0 {
+		if _, err := tx.ExecContext(ctx, `delete from books_genres where book_id = $1`, bookID); err != nil {
+			return err
+		}
+	}
+
+	if err := recordRevision(ctx, tx, bookID, RevisionRevert); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// book returns the changes that put the book with id back to the snapshot,
+// leaving its cover as it is
+func (snap BookSnapshot) book(id int) Book {
+	contributors := []Contributor{}
+	for _, c := range snap.Contributors {
+		contributors = append(contributors, Contributor{AuthorID: c.AuthorID, Role: c.Role})
+	}
+
+	return Book{
+		ID:              id,
+		Title:           snap.Title,
+		AuthorID:        snap.AuthorID,
+		PublicationYear: snap.PublicationYear,
+		Description:     snap.Description,
+		GenreIDs:        snap.GenreIDs,
+		Contributors:    contributors,
+	}
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	base := BookSnapshot{
+		Title:           "Salem's Lot",
+		AuthorID:        1,
+		PublicationYear: 1975,
+		Slug:            "salem-s-lot",
+		GenreIDs:        []int{1},
+		Contributors:    []SnapshotCredit{{AuthorID: 1, Role: ContributorAuthor, Position: 1}},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *BookSnapshot)
+		fields []string
+	}{
+		{"unchanged", func(s *BookSnapshot) {}, []string{}},
+		{"title and slug", func(s *BookSnapshot) { s.Title, s.Slug = "'Salem's Lot", "salem-s-lot-2" }, []string{"title", "slug"}},
+		{"year", func(s *BookSnapshot) { s.PublicationYear = 1976 }, []string{"publication_year"}},
+		{"genres", func(s *BookSnapshot) { s.GenreIDs = []int{1, 2} }, []string{"genre_ids"}},
+		{"no genres", func(s *BookSnapshot) { s.GenreIDs = nil }, []string{"genre_ids"}},
+		{"cover", func(s *BookSnapshot) { s.Cover, s.Covers = "1/abc.jpg", CoverSet{"card": {}} }, []string{"cover", "covers"}},
+		{"contributor role", func(s *BookSnapshot) { s.Contributors[0].Role = ContributorEditor }, []string{"contributors"}},
+		{"every field in order", func(s *BookSnapshot) {
+			*s = BookSnapshot{Title: "It", AuthorID: 2, PublicationYear: 1986, Slug: "it", Description: "Derry", Cover: "it.jpg", Covers: CoverSet{"card": {}}, GenreIDs: []int{3}}
+		}, snapshotFields},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to := base
+			to.GenreIDs = append([]int(nil), base.GenreIDs...)
+			to.Contributors = append([]SnapshotCredit(nil), base.Contributors...)
+			tt.modify(&to)
+
+			changes, err := DiffSnapshots(base, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fields := []string{}
+			for _, c := range changes {
+				fields = append(fields, c.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Fatalf("changed fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+
+	// nil and empty lists are the same
+	changes, err := DiffSnapshots(BookSnapshot{}, BookSnapshot{GenreIDs: []int{}, Contributors: []SnapshotCredit{}, Covers: CoverSet{}})
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("changes = %+v, %v, want none", changes, err)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ids, err := seedBooks(models, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			original, err := models.Book.GetOneById(ctx, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			edited := *original
+			edited.Title = original.Title + " Revised"
+			edited.PublicationYear = 2010
+			edited.Description = "Revised edition"
+			edited.GenreIDs = original.GenreIDs[:1]
+			edited.Contributors = nil
+			if err := models.Book.Update(ctx, edited); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := models.Book.Revert(ctx, original.ID, 99, 0); err == nil {
+				t.Fatal("reverted to a revision that does not exist")
+			}
+			// a revert made from the version before the edit is a conflict
+			if err := models.Book.Revert(ctx, original.ID, 1, original.Version); !errors.Is(err, ErrEditConflict) {
+				t.Fatalf("revert over a stale version: err = %v, want ErrEditConflict", err)
+			}
+			if err := models.Book.Revert(ctx, original.ID, 1, original.Version+1); err != nil {
+				t.Fatal(err)
+			}
+
+			reverted, err := models.Book.GetOneById(ctx, original.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reverted.Title != original.Title || reverted.Slug != original.Slug || reverted.PublicationYear != original.PublicationYear ||
+				reverted.Description != original.Description || !reflect.DeepEqual(reverted.GenreIDs, original.GenreIDs) {
+				t.Fatalf("reverted to %+v, want %+v", reverted, original)
+			}
+			if reverted.Version != original.Version+2 {
+				t.Fatalf("version = %d, want %d", reverted.Version, original.Version+2)
+			}
+
+			revisions, err := models.Book.Revisions(ctx, original.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 3 || revisions[0].Action != RevisionRevert {
+				t.Fatalf("%d revisions, want create, update and revert", len(revisions))
+			}
+
+			changes, err := DiffSnapshots(revisions[2].Snapshot, revisions[0].Snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != 0 {
+				t.Fatalf("revert differs from the revision it went back to: %+v", changes)
+			}
+		})
+	}
+}
+
+func TestRevertAfterGenreMerge(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			suffix := time.Now().UnixNano()
+
+			authorID, err := models.Author.Insert(ctx, Author{AuthorName: fmt.Sprintf("Merge Author %d", suffix)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			genres := map[string]int{}
+			for _, n := range []string{"Spooky", "Scary", "Horror", "Weird", "Dread"} {
+				id, err := models.Genre.Insert(ctx, Genre{GenreName: fmt.Sprintf("%s %d", n, suffix)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				genres[n] = id
+			}
+
+			bookID, err := models.Book.Insert(ctx, Book{
+				Title:           fmt.Sprintf("Merged Book %d", suffix),
+				AuthorID:        authorID,
+				PublicationYear: 1980,
+				GenreIDs:        []int{genres["Spooky"], genres["Scary"], genres["Weird"], genres["Dread"]},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// spooky and scary go into horror, which then goes into dread, and
+			// weird is deleted
+			steps := []func() error{
+				func() error { return models.Genre.Merge(ctx, genres["Spooky"], genres["Horror"]) },
+				func() error { return models.Genre.Merge(ctx, genres["Scary"], genres["Horror"]) },
+				func() error { return models.Genre.Merge(ctx, genres["Horror"], genres["Dread"]) },
+				func() error { return models.Genre.DeleteByID(ctx, genres["Weird"]) },
+			}
+			for _, step := range steps {
+				if err := step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := models.Book.Revert(ctx, bookID, 1, 0); err != nil {
+				t.Fatalf("reverting to a revision from before the merge: %v", err)
+			}
+
+			book, err := models.Book.GetOneById(ctx, bookID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{genres["Dread"]}; !reflect.DeepEqual(book.GenreIDs, want) {
+				t.Fatalf("genres = %v, want %v", book.GenreIDs, want)
+			}
+
+			// with every genre it had gone, the book is left without any
+			if err := models.Genre.DeleteByID(ctx, genres["Dread"]); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Book.Revert(ctx, bookID, 1, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			book, err = models.Book.GetOneById(ctx, bookID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(book.GenreIDs) != 0 {
+				t.Fatalf("genres = %v, want none", book.GenreIDs)
+			}
+		})
+	}
+}
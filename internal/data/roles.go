@@ -0,0 +1,72 @@
+package data
+
+// roles a user can have, from least to most privileged
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// permissions checked by the admin routes
+const (
+	PermUsersRead    = "users:read"
+	PermUsersWrite   = "users:write"
+	PermBooksRead    = "books:read"
+	PermBooksWrite   = "books:write"
+	PermAuthorsRead  = "authors:read"
+	PermAuthorsWrite = "authors:write"
+	PermGenresRead   = "genres:read"
+	PermGenresWrite  = "genres:write"
+	PermTrashPurge   = "trash:purge"
+	PermAuditRead    = "audit:read"
+)
+
+// rolePermissions lists what each role is allowed to do
+var rolePermissions = map[string][]string{
+	RoleViewer: {
+		PermBooksRead,
+		PermAuthorsRead,
+		PermGenresRead,
+	},
+	RoleEditor: {
+		PermBooksRead,
+		PermBooksWrite,
+		PermAuthorsRead,
+		PermAuthorsWrite,
+		PermGenresRead,
+		PermGenresWrite,
+	},
+	RoleAdmin: {
+		PermUsersRead,
+		PermUsersWrite,
+		PermBooksRead,
+		PermBooksWrite,
+		PermAuthorsRead,
+		PermAuthorsWrite,
+		PermGenresRead,
+		PermGenresWrite,
+		PermTrashPurge,
+		PermAuditRead,
+	},
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Permissions returns everything the user's role allows
+func (u *User) Permissions() []string {
+	return rolePermissions[u.Role]
+}
+
+// Can reports whether the user's role grants permission
+func (u *User) Can(permission string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// BookSearchResult is a book matching a search, with its rank and the
+// matching parts of its title and description wrapped in <mark> tags. The
+// highlights are HTML, the rest of the text in them is escaped.
+type BookSearchResult struct {
+	*Book
+	Rank       float64          `json:"rank"`
+	Highlights SearchHighlights `json:"highlights"`
+}
+
+// SearchHighlights holds the highlighted snippets of a search result
+type SearchHighlights struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// searchTerm is one word, or a quoted phrase of several words, that must all
+// appear in a match. When prefix is set the last word may be the start of a
+// longer word.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+// parseSearch splits a query such as `"dark tower" gunsl*` into terms. Quoted
+// text is a phrase and a trailing * makes a prefix search, anything other
+// than letters and digits is ignored.
+func parseSearch(q string) []searchTerm {
+	var terms []searchTerm
+
+	for i, part := range strings.Split(q, `"`) {
+		phrase := i%2 == 1
+
+		var current searchTerm
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+
+			words := strings.FieldsFunc(strings.ToLower(field), func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			})
+			if len(words) == 0 {
+				continue
+			}
+
+			if !phrase {
+				// words split on punctuation, such as "salem's", stay together
+				terms = append(terms, searchTerm{words: words, prefix: prefix})
+				continue
+			}
+
+			current.words = append(current.words, words...)
+			current.prefix = prefix
+		}
+
+		if len(current.words) > 0 {
+			terms = append(terms, current)
+		}
+	}
+
+	return terms
+}
+
+// tsquery formats terms for to_tsquery, every term must match and the words
+// of a phrase must follow each other
+func tsquery(terms []searchTerm) string {
+	var parts []string
+
+	for _, t := range terms {
+		words := append([]string(nil), t.words...)
+		if t.prefix {
+			words[len(words)-1] += ":*"
+		}
+		parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+	}
+
+	return strings.Join(parts, " & ")
+}
+
+// escapeHTML wraps a text column in the replacements html.EscapeString makes,
+// so the highlights can be shown as HTML without the <mark> tags being the
+// only markup that gets through. The parser reads the entities as entities,
+// not words, so matching is unchanged.
+func escapeHTML(column string) string {
+	expr := column
+	for _, r := range [][2]string{{"&", "&amp;"}, {"'", "&#39;"}, {"<", "&lt;"}, {">", "&gt;"}, {`"`, "&#34;"}} {
+		expr = "replace(" + expr + ", '" + strings.ReplaceAll(r[0], "'", "''") + "', '" + r[1] + "')"
+	}
+	return expr
+}
+
+// Search returns up to limit books matching q, best matches first
+func (s *postgresBookStore) Search(ctx context.Context, q string, limit int) ([]*BookSearchResult, error) {
+	terms := parseSearch(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + bookColumns + `,
+			ts_rank(b.search_vector, q.query) as rank,
+			ts_headline('english', ` + escapeHTML("b.title") + `, q.query, 'HighlightAll=true, StartSel=<mark>, StopSel=</mark>'),
+			ts_headline('english', ` + escapeHTML("b.description") + `, q.query, 'MaxFragments=2, MinWords=10, MaxWords=30, StartSel=<mark>, StopSel=</mark>')
+			from books b
+			join to_tsquery('english', $1) q(query) on (b.search_vector @@ q.query)
+			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is null
+			order by rank desc, b.title
+			limit $2`
+
+	var results []*BookSearchResult
+
+	rows, err := s.db.QueryContext(ctx, query, tsquery(terms), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book Book
+		result := BookSearchResult{Book: &book}
+		err := scanBook(rows, &book, &result.Rank, &result.Highlights.Title, &result.Highlights.Description)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	books := make([]*Book, len(results))
+	for i, result := range results {
+		books[i] = result.Book
+	}
+
+	if err := s.loadRelations(ctx, books); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
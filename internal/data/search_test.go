@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		name  string
+		q     string
+		terms []searchTerm
+		query string
+	}{
+		{"empty", "", nil, ""},
+		{"only punctuation", `-- ! "" *`, nil, ""},
+		{"words", "Dark Tower", []searchTerm{{words: []string{"dark"}}, {words: []string{"tower"}}}, "(dark) & (tower)"},
+		{"prefix", "gunsl*", []searchTerm{{words: []string{"gunsl"}, prefix: true}}, "(gunsl:*)"},
+		{"phrase", `"the dark tower"`, []searchTerm{{words: []string{"the", "dark", "tower"}}}, "(the <-> dark <-> tower)"},
+		{"phrase and prefix", `"dark tower" gunsl*`, []searchTerm{{words: []string{"dark", "tower"}}, {words: []string{"gunsl"}, prefix: true}}, "(dark <-> tower) & (gunsl:*)"},
+		{"prefix phrase", `"salem lo*"`, []searchTerm{{words: []string{"salem", "lo"}, prefix: true}}, "(salem <-> lo:*)"},
+		{"punctuation inside a word", "salem's", []searchTerm{{words: []string{"salem", "s"}}}, "(salem <-> s)"},
+		{"unclosed quote", `it "dark tower`, []searchTerm{{words: []string{"it"}}, {words: []string{"dark", "tower"}}}, "(it) & (dark <-> tower)"},
+		{"tsquery operators", "a & !b | c:*", []searchTerm{{words: []string{"a"}}, {words: []string{"b"}}, {words: []string{"c"}, prefix: true}}, "(a) & (b) & (c:*)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := parseSearch(tt.q)
+			if !reflect.DeepEqual(terms, tt.terms) {
+				t.Fatalf("parseSearch(%q) = %+v, want %+v", tt.q, terms, tt.terms)
+			}
+			if query := tsquery(terms); query != tt.query {
+				t.Fatalf("tsquery = %q, want %q", query, tt.query)
+			}
+		})
+	}
+}
+
+func TestSearchEscapesHighlights(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			word := fmt.Sprintf("Escaped%d", time.Now().UnixNano())
+
+			authorID, err := models.Author.Insert(ctx, Author{AuthorName: "Author of " + word})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = models.Book.Insert(ctx, Book{
+				Title:           fmt.Sprintf(`<b>Tom & Jerry</b> %s`, word),
+				Description:     fmt.Sprintf(`<script>alert(1)</script> %s`, word),
+				AuthorID:        authorID,
+				PublicationYear: 2001,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := models.Book.Search(ctx, word, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("%d results, want 1", len(results))
+			}
+
+			h := results[0].Highlights
+			if want := "&lt;b&gt;Tom &amp; Jerry&lt;/b&gt; <mark>" + word + "</mark>"; h.Title != want {
+				t.Fatalf("title highlight = %q, want %q", h.Title, want)
+			}
+			if strings.Contains(h.Description, "<script>") || !strings.Contains(h.Description, "<mark>"+word+"</mark>") {
+				t.Fatalf("description highlight = %q", h.Description)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mozillazg/go-slugify"
+)
+
+// freeSlug returns base, or base with the lowest suffix from -2 up that is
+// not taken
+func freeSlug(base string, taken map[string]bool) string {
+	if !taken[base] {
+		return base
+	}
+
+	for n := 2; ; n++ {
+		slug := fmt.Sprintf("%s-%d", base, n)
+		if !taken[slug] {
+			return slug
+		}
+	}
+}
+
+// baseSlug is the slug a title would have if no other book shared it
+func baseSlug(title string) string {
+	if slug := slugify.Slugify(title); slug != "" {
+		return slug
+	}
+	return "book"
+}
+
+// bookSlug picks a slug for the book with bookID, 0 for a new one, that no
+// other book has now or had before. The book may take back one of its own
+// old slugs.
+func bookSlug(ctx context.Context, tx *sql.Tx, title string, bookID int) (string, error) {
+	base := baseSlug(title)
+
+	// books with the same title wait for each other, so two of them can't
+	// both pick the same free slug
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext('book_slug:' || $1))`, base); err != nil {
+		return "", err
+	}
+
+	// slugs only hold a-z, 0-9 and -, so base needs no escaping in like
+	query := `select slug from books where id <> $1 and (slug = $2 or slug like $2 || '-%')
+		union
+		select slug from book_slugs where book_id <> $1 and (slug = $2 or slug like $2 || '-%')`
+
+	rows, err := tx.QueryContext(ctx, query, bookID, base)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := map[string]bool{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return freeSlug(base, taken), nil
+}
+
+// rowSlug picks a slug for name that no other row of table, authors or
+// genres, has, suffixed like a book slug when the name is shared. The row
+// with id, 0 for a new one, may keep its own slug.
+func rowSlug(ctx context.Context, tx *sql.Tx, table, name string, id int) (string, error) {
+	base := slugify.Slugify(name)
+
+	// rows with the same name wait for each other, like books do
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext($1 || '_slug:' || $2))`, table, base); err != nil {
+		return "", err
+	}
+
+	query := fmt.Sprintf(`select slug from %s where id <> $1 and (slug = $2 or slug like $2 || '-%%')`, table)
+
+	rows, err := tx.QueryContext(ctx, query, id, base)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := map[string]bool{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return freeSlug(base, taken), nil
+}
+
+// moveSlug records that a book's slug changed from oldSlug to newSlug, so
+// the old one keeps pointing at the book
+func moveSlug(ctx context.Context, tx *sql.Tx, bookID int, oldSlug, newSlug string) error {
+	if oldSlug == newSlug {
+		return nil
+	}
+
+	stmt := `insert into book_slugs (slug, book_id, created_at) values ($1, $2, $3)
+		on conflict (slug) do update set book_id = excluded.book_id, created_at = excluded.created_at`
+	if _, err := tx.ExecContext(ctx, stmt, oldSlug, bookID, time.Now()); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `delete from book_slugs where slug = $1`, newSlug)
+	return err
+}
+
+// CurrentSlug returns the slug of the book that used to be at oldSlug, or
+// sql.ErrNoRows when no book ever had it
+func (s *postgresBookStore) CurrentSlug(ctx context.Context, oldSlug string) (string, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select b.slug from book_slugs bs join books b on (b.id = bs.book_id) where bs.slug = $1 and b.deleted_at is null`
+
+	var slug string
+	if err := s.db.QueryRowContext(ctx, query, oldSlug).Scan(&slug); err != nil {
+		return "", err
+	}
+
+	return slug, nil
+}
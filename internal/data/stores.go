@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UserStore is the persistence contract for users
+type UserStore interface {
+	GetAllUsers(ctx context.Context) ([]*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserById(ctx context.Context, id int) (*User, error)
+	UpdateUser(ctx context.Context, user User) (int, error)
+	AddUser(ctx context.Context, user User) (int, error)
+	ResetUserPassword(ctx context.Context, id int, password string) error
+	DeleteUserById(ctx context.Context, id int) error
+	TrashedUsers(ctx context.Context) ([]*User, error)
+	RestoreUser(ctx context.Context, id int) error
+	PurgeUsers(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// TokenStore is the persistence contract for authentication tokens
+type TokenStore interface {
+	GetUserByToken(ctx context.Context, plainText string) (*Token, error)
+	GetUserForToken(ctx context.Context, token Token) (*User, error)
+	GenerateToken(userID int, ttl time.Duration) (*Token, error)
+	AuthenticateToken(r *http.Request) (*User, error)
+	DeleteByToken(ctx context.Context, plain string) error
+	InsertToken(ctx context.Context, token Token, u User) error
+	ValidToken(ctx context.Context, plain string) (bool, error)
+	DeleteTokenForUser(ctx context.Context, id int) error
+	SessionsForUser(ctx context.Context, userID int) ([]*Session, error)
+	DeleteSession(ctx context.Context, userID int, id string) error
+	TouchToken(ctx context.Context, id int) error
+}
+
+// RefreshTokenStore is the persistence contract for rotating refresh tokens
+type RefreshTokenStore interface {
+	GenerateRefreshToken(userID int, familyID string, ttl time.Duration) (*RefreshToken, error)
+	Insert(ctx context.Context, rt RefreshToken) error
+	GetByToken(ctx context.Context, plainText string) (*RefreshToken, error)
+	Rotate(ctx context.Context, used RefreshToken, access Token, next RefreshToken) error
+	RevokeFamily(ctx context.Context, familyID string) error
+}
+
+// PasswordResetStore is the persistence contract for password reset tokens
+type PasswordResetStore interface {
+	GeneratePasswordReset(userID int, ttl time.Duration) (*PasswordReset, error)
+	Insert(ctx context.Context, pr PasswordReset) error
+	Consume(ctx context.Context, plainText string) (int, error)
+}
+
+// LoginAttemptStore is the persistence contract for failed login tracking
+type LoginAttemptStore interface {
+	Get(ctx context.Context, key string) (*LoginAttempt, error)
+	RecordFailure(ctx context.Context, key string, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+	AllLocked(ctx context.Context) ([]*LoginAttempt, error)
+}
+
+// MFAStore is the persistence contract for two-factor authentication
+type MFAStore interface {
+	GetTOTP(ctx context.Context, userID int) (*TOTP, error)
+	StartEnrollment(ctx context.Context, userID int, secret string) error
+	Enable(ctx context.Context, userID int, step int64, recoveryCodes []string) error
+	Disable(ctx context.Context, userID int) error
+	UseStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+	GenerateTicket(userID int, ttl time.Duration) (*MFATicket, error)
+	InsertTicket(ctx context.Context, ticket MFATicket) error
+	GetTicket(ctx context.Context, plainText string) (*MFATicket, error)
+	DeleteTicket(ctx context.Context, id int) error
+}
+
+// BookStore is the persistence contract for books and their genres
+type BookStore interface {
+	GetAll(ctx context.Context) ([]*Book, error)
+	GetAllPaginated(ctx context.Context, page, pageSize int) ([]*Book, error)
+	GetAllFiltered(ctx context.Context, f BookFilter) ([]*Book, int, error)
+	GetOneById(ctx context.Context, id int) (*Book, error)
+	GetOneBySlug(ctx context.Context, slug string) (*Book, error)
+	CurrentSlug(ctx context.Context, oldSlug string) (string, error)
+	Search(ctx context.Context, q string, limit int) ([]*BookSearchResult, error)
+	NextID(ctx context.Context) (int, error)
+	Insert(ctx context.Context, book Book) (int, error)
+	Update(ctx context.Context, book Book) error
+	SetCover(ctx context.Context, id int, cover string, covers CoverSet, version int) error
+	DeleteByID(ctx context.Context, id int) error
+	Trashed(ctx context.Context) ([]*Book, error)
+	Restore(ctx context.Context, id int) error
+	Purge(ctx context.Context, cutoff time.Time) ([]*Book, error)
+	Revisions(ctx context.Context, bookID int) ([]*BookRevision, error)
+	Revision(ctx context.Context, bookID, revision int) (*BookRevision, error)
+	Revert(ctx context.Context, bookID, revision, version int) error
+}
+
+// AuthorStore is the persistence contract for authors
+type AuthorStore interface {
+	All(ctx context.Context) ([]*Author, error)
+	GetOneById(ctx context.Context, id int) (*Author, error)
+	GetOneBySlug(ctx context.Context, slug string) (*Author, error)
+	NextID(ctx context.Context) (int, error)
+	Insert(ctx context.Context, author Author) (int, error)
+	Update(ctx context.Context, author Author) error
+	SetPhoto(ctx context.Context, id int, photo string, photos CoverSet) error
+	DeleteByID(ctx context.Context, id int) error
+}
+
+// GenreStore is the persistence contract for genres
+type GenreStore interface {
+	All(ctx context.Context) ([]*GenreWithCount, error)
+	GetOneById(ctx context.Context, id int) (*Genre, error)
+	GetOneBySlug(ctx context.Context, slug string) (*Genre, error)
+	Insert(ctx context.Context, genre Genre) (int, error)
+	Update(ctx context.Context, genre Genre) error
+	DeleteByID(ctx context.Context, id int) error
+	Merge(ctx context.Context, fromID, intoID int) error
+}
+
+// AuditStore is the persistence contract for the append-only audit log
+type AuditStore interface {
+	Record(ctx context.Context, entry AuditEntry) error
+	List(ctx context.Context, f AuditFilter) ([]*AuditEntry, int, error)
+	Export(ctx context.Context, f AuditFilter, fn func(*AuditEntry) error) error
+}
+
+// ErrTokenExpired is returned for an access token past its expiry, clients
+// holding a refresh token can exchange it for a new one
+var ErrTokenExpired = errors.New("expired token")
+
+// ErrEditConflict is returned when a save names a version of a record that
+// has since been changed by someone else
+var ErrEditConflict = errors.New("edit conflict")
+
+// touchInterval is how stale a session's last used time may get
+const touchInterval = time.Minute
+
+// generateToken creates a random token and its hash for a user
+func generateToken(userID int, ttl time.Duration) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+	}
+
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.TokenHash = hashToken(token.Token)
+
+	return token, nil
+}
+
+// hashToken returns the sha-256 hash tokens are stored and looked up by
+func hashToken(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
+
+// authenticateToken checks the bearer token on the request against the store
+func authenticateToken(t TokenStore, r *http.Request) (*User, error) {
+	authorizationHeader := r.Header.Get("Authorization")
+	if authorizationHeader == "" {
+		return nil, errors.New("no authorization header")
+	}
+
+	headersParts := strings.Split(authorizationHeader, " ")
+	if len(headersParts) != 2 || headersParts[0] != "Bearer" {
+		return nil, errors.New("no valid header")
+	}
+
+	token := headersParts[1]
+
+	if len(token) != 26 {
+		return nil, errors.New("token size is not valid")
+	}
+
+	tk, err := t.GetUserByToken(r.Context(), token)
+	if err != nil {
+		return nil, errors.New("not matching token found")
+	}
+
+	if tk.Expiry.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	user, err := t.GetUserForToken(r.Context(), *tk)
+	if err != nil {
+		return nil, errors.New("not matching user found")
+	}
+
+	if user.Active == 0 {
+		return nil, errors.New("user not active")
+	}
+
+	// last used times only need to be roughly right, so skip most writes
+	if time.Since(tk.LastUsedAt) > touchInterval {
+		if err := t.TouchToken(r.Context(), tk.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// validToken reports whether plain is an unexpired token for an existing user
+func validToken(ctx context.Context, t TokenStore, plain string) (bool, error) {
+	token, err := t.GetUserByToken(ctx, plain)
+
+	if err != nil {
+		return false, errors.New("no matching found")
+	}
+
+	_, err = t.GetUserForToken(ctx, *token)
+	if err != nil {
+		return false, errors.New("not matching user found")
+	}
+
+	if token.Expiry.Before(time.Now()) {
+		return false, errors.New("expired token")
+	}
+
+	return true, nil
+}
@@ -0,0 +1,488 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-api/internal/migrations"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// testStores returns the models to run a store test against: always the
+// in-memory store, and the postgres store when TEST_DSN names a database the
+// migrations can be applied to. Postgres is shared between tests, so they
+// must only look at rows they create.
+func testStores(t testing.TB) map[string]Models {
+	t.Helper()
+
+	stores := map[string]Models{"memory": NewMemory()}
+
+	dsn := os.Getenv("TEST_DSN")
+	if dsn == "" {
+		return stores
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	stores["postgres"] = New(db, DefaultTimeouts)
+	return stores
+}
+
+// uniqueEmail returns an address no other test run has used
+func uniqueEmail(name string) string {
+	return fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano())
+}
+
+func TestGetAllUsers(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			email := uniqueEmail("editor")
+			id, err := models.User.AddUser(ctx, User{
+				Email:     email,
+				FirstName: "Ed",
+				LastName:  "Itor",
+				Password:  "password",
+				Active:    1,
+				Role:      RoleEditor,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			users, err := models.User.GetAllUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var found *User
+			for _, u := range users {
+				if u.ID == id {
+					found = u
+				}
+			}
+
+			if found == nil {
+				t.Fatalf("user %d missing from GetAllUsers", id)
+			}
+			if found.Email != email || found.Role != RoleEditor || found.Active != 1 {
+				t.Fatalf("got %s role %q active %d, want %s role %q active 1", found.Email, found.Role, found.Active, email, RoleEditor)
+			}
+		})
+	}
+}
+
+func TestUpdateUserVersion(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			id, err := models.User.AddUser(ctx, User{Email: uniqueEmail("versioned"), FirstName: "Ver", LastName: "Sioned", Password: "password", Active: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := models.User.GetUserById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name    string
+				id      int
+				version int
+				want    int
+				err     error
+			}{
+				{"current version", id, 1, 2, nil},
+				{"stale version", id, 1, 0, ErrEditConflict},
+				{"no version", id, 0, 3, nil},
+				{"unknown user", -1, 0, 0, sql.ErrNoRows},
+			}
+
+			for _, tt := range tests {
+				u := *user
+				u.ID, u.Version = tt.id, tt.version
+
+				version, err := models.User.UpdateUser(ctx, u)
+				if !errors.Is(err, tt.err) || version != tt.want {
+					t.Fatalf("%s: UpdateUser = %d, %v, want %d, %v", tt.name, version, err, tt.want, tt.err)
+				}
+			}
+
+			saved, err := models.User.GetUserById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Version != 3 {
+				t.Fatalf("version = %d, want 3", saved.Version)
+			}
+		})
+	}
+}
+
+func TestAuthorSlugs(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			authorName := fmt.Sprintf("Richard Bachman %d", time.Now().UnixNano())
+
+			var slugs []string
+			for i := 0; i < 3; i++ {
+				id, err := models.Author.Insert(ctx, Author{AuthorName: authorName})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				author, err := models.Author.GetOneById(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				slugs = append(slugs, author.Slug)
+			}
+
+			base := slugs[0]
+			if slugs[1] != base+"-2" || slugs[2] != base+"-3" {
+				t.Fatalf("slugs = %v, want %s numbered from -2", slugs, base)
+			}
+		})
+	}
+}
+
+func TestAuthorReservedIDAndPhoto(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			authorName := fmt.Sprintf("Joe Hill %d", time.Now().UnixNano())
+			photos := CoverSet{"thumbnail": {JPEG: CoverImage{Name: "thumb.jpg", Width: 200, Height: 250}}}
+
+			reserved, err := models.Author.NextID(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := models.Author.Insert(ctx, Author{ID: reserved, AuthorName: authorName, Photo: "photo.jpg", Photos: photos})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != reserved {
+				t.Fatalf("id = %d, want the reserved %d", id, reserved)
+			}
+
+			if _, err := models.Author.Insert(ctx, Author{ID: reserved, AuthorName: authorName}); err == nil {
+				t.Fatal("second author saved under the same id")
+			}
+
+			// an update without a photo keeps the one there is
+			if err := models.Author.Update(ctx, Author{ID: id, AuthorName: authorName, Bio: "Bio"}); err != nil {
+				t.Fatal(err)
+			}
+			author, err := models.Author.GetOneById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if author.Photo != "photo.jpg" || author.Photos["thumbnail"].JPEG.Name != "thumb.jpg" || author.Bio != "Bio" {
+				t.Fatalf("author = %+v, want the photo kept and the bio changed", author)
+			}
+
+			if err := models.Author.Update(ctx, Author{ID: id, AuthorName: authorName, Photo: "other.jpg"}); err != nil {
+				t.Fatal(err)
+			}
+			author, err = models.Author.GetOneById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if author.Photo != "other.jpg" || len(author.Photos) != 0 {
+				t.Fatalf("photo %q with %d sizes, want other.jpg alone", author.Photo, len(author.Photos))
+			}
+		})
+	}
+}
+
+func TestGenreSlugs(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			genreName := fmt.Sprintf("Cosmic Horror %d", time.Now().UnixNano())
+
+			var slugs []string
+			for _, n := range []string{genreName, genreName + "!", genreName + "?"} {
+				id, err := models.Genre.Insert(ctx, Genre{GenreName: n})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				genre, err := models.Genre.GetOneById(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				slugs = append(slugs, genre.Slug)
+			}
+
+			base := slugs[0]
+			if slugs[1] != base+"-2" || slugs[2] != base+"-3" {
+				t.Fatalf("slugs = %v, want %s numbered from -2", slugs, base)
+			}
+		})
+	}
+}
+
+func TestGenreChangesRecordRevisions(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			suffix := time.Now().UnixNano()
+
+			authorID, err := models.Author.Insert(ctx, Author{AuthorName: fmt.Sprintf("Genre Author %d", suffix)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var genreIDs []int
+			for _, n := range []string{"Weird", "Strange", "Odd"} {
+				id, err := models.Genre.Insert(ctx, Genre{GenreName: fmt.Sprintf("%s %d", n, suffix)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				genreIDs = append(genreIDs, id)
+			}
+			weird, strange, odd := genreIDs[0], genreIDs[1], genreIDs[2]
+
+			bookID, err := models.Book.Insert(ctx, Book{
+				Title:           fmt.Sprintf("Genre Book %d", suffix),
+				AuthorID:        authorID,
+				PublicationYear: 1990,
+				GenreIDs:        []int{weird, odd},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before, err := models.Book.GetOneById(ctx, bookID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := func(step string, version int, genreIDs []int) {
+				t.Helper()
+
+				book, err := models.Book.GetOneById(ctx, bookID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if book.Version != version {
+					t.Fatalf("after %s version = %d, want %d", step, book.Version, version)
+				}
+
+				revisions, err := models.Book.Revisions(ctx, bookID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				latest := revisions[0]
+				if latest.Action != RevisionGenres || fmt.Sprint(latest.Snapshot.GenreIDs) != fmt.Sprint(genreIDs) {
+					t.Fatalf("after %s latest revision is %s with genres %v, want %s with %v", step, latest.Action, latest.Snapshot.GenreIDs, RevisionGenres, genreIDs)
+				}
+			}
+
+			if err := models.Genre.Merge(ctx, weird, strange); err != nil {
+				t.Fatal(err)
+			}
+			expect("merge", before.Version+1, []int{strange, odd})
+
+			if err := models.Genre.DeleteByID(ctx, odd); err != nil {
+				t.Fatal(err)
+			}
+			expect("delete", before.Version+2, []int{strange})
+		})
+	}
+}
+
+func TestBookAuthorFromContributors(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			suffix := time.Now().UnixNano()
+
+			authorID, err := models.Author.Insert(ctx, Author{AuthorName: fmt.Sprintf("Credited Author %d", suffix)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a credit without a role is an author credit
+			bookID, err := models.Book.Insert(ctx, Book{
+				Title:           fmt.Sprintf("Credited Book %d", suffix),
+				PublicationYear: 2001,
+				Contributors:    []Contributor{{AuthorID: authorID}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			book, err := models.Book.GetOneById(ctx, bookID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.AuthorID != authorID {
+				t.Fatalf("author id = %d, want %d", book.AuthorID, authorID)
+			}
+		})
+	}
+}
+
+func TestBookReservedID(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ids, err := seedBooks(models, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seeded, err := models.Book.GetOneById(ctx, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reserved, err := models.Book.NextID(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			book := Book{
+				ID:              reserved,
+				Title:           seeded.Title + " Reserved",
+				AuthorID:        seeded.AuthorID,
+				PublicationYear: 2002,
+				Cover:           "cover.jpg",
+			}
+			id, err := models.Book.Insert(ctx, book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != reserved {
+				t.Fatalf("id = %d, want the reserved %d", id, reserved)
+			}
+
+			if _, err := models.Book.Insert(ctx, book); err == nil {
+				t.Fatal("second book saved under the same id")
+			}
+
+			saved, err := models.Book.GetOneById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Cover != "cover.jpg" || saved.Version != 1 {
+				t.Fatalf("cover %q at version %d, want cover.jpg at 1", saved.Cover, saved.Version)
+			}
+		})
+	}
+}
+
+func TestSetCoverVersion(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ids, err := seedBooks(models, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			book, err := models.Book.GetOneById(ctx, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := models.Book.SetCover(ctx, book.ID, "cover.jpg", nil, book.Version); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Book.SetCover(ctx, book.ID, "other.jpg", nil, book.Version); !errors.Is(err, ErrEditConflict) {
+				t.Fatalf("SetCover over a stale version: err = %v, want ErrEditConflict", err)
+			}
+
+			saved, err := models.Book.GetOneById(ctx, book.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Cover != "cover.jpg" || saved.Version != book.Version+1 {
+				t.Fatalf("cover %q at version %d, want cover.jpg at %d", saved.Cover, saved.Version, book.Version+1)
+			}
+		})
+	}
+}
+
+func TestTokensByHash(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			user := User{Email: uniqueEmail("token"), FirstName: "To", LastName: "Ken", Password: "password", Active: 1, Role: RoleViewer}
+			id, err := models.User.AddUser(ctx, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.ID = id
+
+			tests := []struct {
+				name    string
+				ttl     time.Duration
+				lookup  func(plain string) string
+				valid   bool
+				message string
+			}{
+				{"plaintext", time.Hour, func(p string) string { return p }, true, "the plaintext finds its token"},
+				{"stored hash", time.Hour, func(p string) string { return string(hashToken(p)) }, false, "the hash is not a token"},
+				{"expired", -time.Minute, func(p string) string { return p }, false, "an expired token is not valid"},
+			}
+
+			for _, tt := range tests {
+				token, err := models.Token.GenerateToken(user.ID, tt.ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(token.TokenHash, hashToken(token.Token)) {
+					t.Fatalf("%s: hash is not the sha-256 of the token", tt.name)
+				}
+
+				if err := models.Token.InsertToken(ctx, *token, user); err != nil {
+					t.Fatal(err)
+				}
+
+				// an invalid token comes with an error saying why
+				valid, err := models.Token.ValidToken(ctx, tt.lookup(token.Token))
+				if tt.valid && err != nil {
+					t.Fatal(err)
+				}
+				if valid != tt.valid {
+					t.Fatalf("%s: valid = %v, %s", tt.name, valid, tt.message)
+				}
+
+				if tt.valid {
+					stored, err := models.Token.GetUserByToken(ctx, token.Token)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if stored.Token != "" || stored.UserID != user.ID {
+						t.Fatalf("%s: stored token %+v keeps its plaintext or lost its user", tt.name, stored)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Trashed returns the books in the trash, most recently deleted first
+func (s *postgresBookStore) Trashed(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select ` + bookColumns + `
+			from books b
+			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is not null
+			order by b.deleted_at desc, b.id`
+
+	return s.queryBooks(ctx, query)
+}
+
+// Restore takes a book back out of the trash. Its slug was kept for it, so
+// it comes back at the same address.
+func (s *postgresBookStore) Restore(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update books set deleted_at = null, updated_at = $1, version = version + 1 where id = $2 and deleted_at is not null`
+
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := recordRevision(ctx, tx, id, RevisionRestore); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Purge deletes for good the books that went into the trash before cutoff.
+// It returns them so the caller can remove their cover files.
+func (s *postgresBookStore) Purge(ctx context.Context, cutoff time.Time) ([]*Book, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	query := `delete from books where deleted_at < $1 returning id, title, cover, covers`
+
+	rows, err := s.db.QueryContext(ctx, query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []*Book
+
+	for rows.Next() {
+		var book Book
+		if err := rows.Scan(&book.ID, &book.Title, &book.Cover, &book.Covers); err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+
+	return books, rows.Err()
+}
+
+// TrashedUsers returns the users in the trash, most recently deleted first
+func (s *postgresUserStore) TrashedUsers(ctx context.Context) ([]*User, error) {
+	ctx, cancel := s.timeouts.read(ctx)
+	defer cancel()
+
+	query := `select id, email, first_name, last_name, user_active, role, created_at, updated_at, deleted_at, version
+	from users where deleted_at is not null order by deleted_at desc, id`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Active,
+			&user.Role,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.DeletedAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// RestoreUser takes a user back out of the trash, they have to log in again.
+// It fails on the unique email index when their email was registered again
+// while they were in the trash.
+func (s *postgresUserStore) RestoreUser(ctx context.Context, id int) error {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	query := `update users set deleted_at = null, updated_at = $1, version = version + 1 where id = $2 and deleted_at is not null`
+
+	result, err := s.db.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// PurgeUsers deletes for good the users that went into the trash before
+// cutoff, and returns how many there were
+func (s *postgresUserStore) PurgeUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	ctx, cancel := s.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `delete from users where deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(affected), nil
+}
@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBookTrash(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ids, err := seedBooks(models, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trashed, kept := ids[0], ids[1]
+
+			if err := models.Book.DeleteByID(ctx, trashed); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Book.DeleteByID(ctx, trashed); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("deleting a book in the trash: err = %v, want sql.ErrNoRows", err)
+			}
+			if _, err := models.Book.GetOneById(ctx, trashed); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("reading a book in the trash: err = %v, want sql.ErrNoRows", err)
+			}
+
+			inTrash := func() map[int]bool {
+				t.Helper()
+				books, err := models.Book.Trashed(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := map[int]bool{}
+				for _, b := range books {
+					found[b.ID] = true
+				}
+				return found
+			}
+
+			if found := inTrash(); !found[trashed] || found[kept] {
+				t.Fatalf("trash has %d: %v, %d: %v, want only the deleted book", trashed, found[trashed], kept, found[kept])
+			}
+
+			if err := models.Book.Restore(ctx, trashed); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Book.Restore(ctx, kept); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("restoring a book outside the trash: err = %v, want sql.ErrNoRows", err)
+			}
+
+			book, err := models.Book.GetOneById(ctx, trashed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.Version != 3 {
+				t.Fatalf("version after delete and restore = %d, want 3", book.Version)
+			}
+
+			revisions, err := models.Book.Revisions(ctx, trashed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 3 || revisions[0].Action != RevisionRestore || revisions[1].Action != RevisionDelete {
+				t.Fatalf("%d revisions, want create, delete and restore", len(revisions))
+			}
+
+			if err := models.Book.DeleteByID(ctx, trashed); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name   string
+				cutoff time.Time
+				purged bool
+			}{
+				{"deleted after the cutoff", time.Now().Add(-time.Hour), false},
+				{"deleted before the cutoff", time.Now().Add(time.Second), true},
+			}
+
+			for _, tt := range tests {
+				books, err := models.Book.Purge(ctx, tt.cutoff)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var purged bool
+				for _, b := range books {
+					if b.ID == kept {
+						t.Fatal("purged a book outside the trash")
+					}
+					purged = purged || b.ID == trashed
+				}
+				if purged != tt.purged {
+					t.Fatalf("%s: purged = %v, want %v", tt.name, purged, tt.purged)
+				}
+			}
+
+			if inTrash()[trashed] {
+				t.Fatal("purged book still in the trash")
+			}
+			if err := models.Book.Restore(ctx, trashed); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("restoring a purged book: err = %v, want sql.ErrNoRows", err)
+			}
+			if _, err := models.Book.GetOneById(ctx, kept); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUserTrash(t *testing.T) {
+	for name, models := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			email := uniqueEmail("trashed")
+
+			add := func() (int, error) {
+				return models.User.AddUser(ctx, User{Email: email, FirstName: "Tr", LastName: "Ashed", Password: "password", Active: 1})
+			}
+
+			id, err := add()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := add(); err == nil {
+				t.Fatal("second user registered with an email in use")
+			}
+
+			if err := models.User.DeleteUserById(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := models.User.GetUserById(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("reading a user in the trash: err = %v, want sql.ErrNoRows", err)
+			}
+
+			trashed, err := models.User.TrashedUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found bool
+			for _, u := range trashed {
+				found = found || u.ID == id
+			}
+			if !found {
+				t.Fatalf("user %d missing from the trash", id)
+			}
+
+			// the email of a user in the trash can be registered again, and
+			// then the user cannot be restored until one of them changes it
+			again, err := add()
+			if err != nil {
+				t.Fatalf("registering the email of a user in the trash: %v", err)
+			}
+			if err := models.User.RestoreUser(ctx, id); err == nil || !strings.Contains(err.Error(), "SQLSTATE 23505") {
+				t.Fatalf("restoring over a registered email: err = %v, want a unique violation", err)
+			}
+
+			if err := models.User.DeleteUserById(ctx, again); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.User.RestoreUser(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.User.RestoreUser(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("restoring a user outside the trash: err = %v, want sql.ErrNoRows", err)
+			}
+
+			user, err := models.User.GetUserById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != email {
+				t.Fatalf("restored email = %s, want %s", user.Email, email)
+			}
+
+			if _, err := models.User.PurgeUsers(ctx, time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := models.User.GetUserById(ctx, id); err != nil {
+				t.Fatalf("purge removed a restored user: %v", err)
+			}
+			if err := models.User.RestoreUser(ctx, again); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("restoring a purged user: err = %v, want sql.ErrNoRows", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var templates embed.FS
+
+// Mailer sends templated emails through an SMTP server
+type Mailer struct {
+	addr   string
+	auth   smtp.Auth
+	from   string
+	sender string
+}
+
+// Message is one email to send. Template names a file in templates/ that
+// defines the "subject", "plainBody" and "htmlBody" blocks, Data is passed to
+// each of them.
+type Message struct {
+	To       string
+	Template string
+	Data     interface{}
+}
+
+// New returns a Mailer for the SMTP server at host:port. Username may be empty
+// for servers that do not need authentication, like MailHog.
+func New(host string, port int, username, password, from string) *Mailer {
+	m := &Mailer{
+		addr:   fmt.Sprintf("%s:%d", host, port),
+		from:   from,
+		sender: from,
+	}
+
+	// from may carry a display name, the SMTP envelope needs the bare address
+	if addr, err := mail.ParseAddress(from); err == nil {
+		m.sender = addr.Address
+	}
+
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+// Send renders msg and delivers it as a multipart text and html email
+func (m *Mailer) Send(msg Message) error {
+	subject, plainBody, htmlBody, err := render(msg)
+	if err != nil {
+		return err
+	}
+
+	body, err := m.build(msg.To, subject, plainBody, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.sender, []string{msg.To}, body)
+}
+
+// render executes the three blocks of the message's template
+func render(msg Message) (string, string, string, error) {
+	name := "templates/" + msg.Template
+
+	textTmpl, err := texttemplate.New("email").ParseFS(templates, name)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	subject := new(bytes.Buffer)
+	if err := textTmpl.ExecuteTemplate(subject, "subject", msg.Data); err != nil {
+		return "", "", "", err
+	}
+
+	plainBody := new(bytes.Buffer)
+	if err := textTmpl.ExecuteTemplate(plainBody, "plainBody", msg.Data); err != nil {
+		return "", "", "", err
+	}
+
+	htmlTmpl, err := htmltemplate.New("email").ParseFS(templates, name)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	if err := htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", msg.Data); err != nil {
+		return "", "", "", err
+	}
+
+	return strings.TrimSpace(subject.String()), plainBody.String(), htmlBody.String(), nil
+}
+
+// build assembles the raw multipart/alternative message
+func (m *Mailer) build(to, subject, plainBody, htmlBody string) ([]byte, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", plainBody},
+		{"text/html", htmlBody},
+	} {
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		qp := quotedprintable.NewWriter(&buf)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "\r\n")
+	}
+
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
+
+func randomBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
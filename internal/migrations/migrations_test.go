@@ -0,0 +1,94 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	file := func(body string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(body)}
+	}
+
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int64
+		err      string
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"sql/000010_later.up.sql":   file("create table b ();"),
+				"sql/000002_first.up.sql":   file("create table a ();"),
+				"sql/000002_first.down.sql": file("drop table a;"),
+			},
+			versions: []int64{2, 10},
+		},
+		{
+			name:  "bad file name",
+			files: fstest.MapFS{"sql/2_first.sql": file("")},
+			err:   "invalid migration file name",
+		},
+		{
+			name: "names differ",
+			files: fstest.MapFS{
+				"sql/000001_first.up.sql":   file("select 1;"),
+				"sql/000001_other.down.sql": file("select 1;"),
+			},
+			err: "mismatched names",
+		},
+		{
+			name:  "down without up",
+			files: fstest.MapFS{"sql/000001_first.down.sql": file("select 1;")},
+			err:   "has no up file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := load(tt.files)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var versions []int64
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			if len(versions) != len(tt.versions) {
+				t.Fatalf("versions = %v, want %v", versions, tt.versions)
+			}
+			for i := range versions {
+				if versions[i] != tt.versions[i] {
+					t.Fatalf("versions = %v, want %v", versions, tt.versions)
+				}
+			}
+		})
+	}
+}
+
+// TestEmbedded checks the shipped migrations load, are numbered without
+// gaps and can all be rolled back
+func TestEmbedded(t *testing.T) {
+	migrations, err := load(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Fatalf("migration %d_%s follows version %d", m.Version, m.Name, i)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			t.Fatalf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
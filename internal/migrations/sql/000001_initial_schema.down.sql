@@ -0,0 +1,6 @@
+drop table if exists books_genres;
+drop table if exists genres;
+drop table if exists books;
+drop table if exists authors;
+drop table if exists tokens;
+drop table if exists users;
@@ -0,0 +1,61 @@
+create table if not exists users (
+    id serial primary key,
+    email varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    password varchar(60) not null,
+    user_active integer not null default 1,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create table if not exists tokens (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    email varchar(255) not null default '',
+    token varchar(255) not null unique,
+    token_hash bytea not null,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now(),
+    expiry timestamp without time zone not null
+);
+
+create index if not exists tokens_user_id_idx on tokens (user_id);
+
+create table if not exists authors (
+    id serial primary key,
+    author_name varchar(512) not null,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create table if not exists books (
+    id serial primary key,
+    title varchar(512) not null,
+    author_id integer not null references authors (id),
+    publication_year integer not null default 0,
+    slug varchar(512) not null unique,
+    description text not null default '',
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create index if not exists books_author_id_idx on books (author_id);
+
+create table if not exists genres (
+    id serial primary key,
+    genre_name varchar(255) not null,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create table if not exists books_genres (
+    id serial primary key,
+    book_id integer not null references books (id) on delete cascade,
+    genre_id integer not null references genres (id) on delete cascade,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now(),
+    unique (book_id, genre_id)
+);
+
+create index if not exists books_genres_genre_id_idx on books_genres (genre_id);
@@ -0,0 +1,6 @@
+-- plaintext tokens cannot be recovered, so every session is dropped
+drop index if exists tokens_token_hash_idx;
+
+delete from tokens;
+
+alter table tokens add column token varchar(255) not null unique;
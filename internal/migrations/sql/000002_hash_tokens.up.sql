@@ -0,0 +1,8 @@
+-- tokens are only ever looked up by their sha-256 hash, so backfill the hash
+-- for any existing row and throw away the plaintext column
+update tokens set token_hash = sha256(convert_to(token, 'UTF8'))
+    where token_hash is null or token_hash <> sha256(convert_to(token, 'UTF8'));
+
+alter table tokens drop column token;
+
+create unique index if not exists tokens_token_hash_idx on tokens (token_hash);
@@ -0,0 +1,4 @@
+alter table tokens
+    drop column last_used_at,
+    drop column user_agent,
+    drop column ip_address;
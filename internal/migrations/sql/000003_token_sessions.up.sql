@@ -0,0 +1,5 @@
+-- every token is a session, users may have several of them at once
+alter table tokens
+    add column last_used_at timestamp without time zone not null default now(),
+    add column user_agent varchar(512) not null default '',
+    add column ip_address varchar(64) not null default '';
@@ -0,0 +1,5 @@
+drop table if exists refresh_tokens;
+
+drop index if exists tokens_family_id_idx;
+
+alter table tokens drop column family_id;
@@ -0,0 +1,17 @@
+-- a family is every access and refresh token descended from a single login
+alter table tokens add column family_id varchar(64) not null default '';
+
+create index if not exists tokens_family_id_idx on tokens (family_id);
+
+create table if not exists refresh_tokens (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    family_id varchar(64) not null,
+    token_hash bytea not null unique,
+    created_at timestamp without time zone not null default now(),
+    expiry timestamp without time zone not null,
+    used_at timestamp without time zone
+);
+
+create index if not exists refresh_tokens_family_id_idx on refresh_tokens (family_id);
+create index if not exists refresh_tokens_user_id_idx on refresh_tokens (user_id);
@@ -0,0 +1,5 @@
+alter table users add column role varchar(32) not null default 'viewer'
+    check (role in ('viewer', 'editor', 'admin'));
+
+-- everyone could do everything before roles existed, keep it that way
+update users set role = 'admin';
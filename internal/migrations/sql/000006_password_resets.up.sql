@@ -0,0 +1,10 @@
+create table if not exists password_resets (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash bytea not null unique,
+    created_at timestamp without time zone not null default now(),
+    expiry timestamp without time zone not null,
+    used_at timestamp without time zone
+);
+
+create index if not exists password_resets_user_id_idx on password_resets (user_id);
@@ -0,0 +1,10 @@
+-- failed logins are counted per key, which is either "email:<address>" or
+-- "ip:<address>" so accounts and clients are throttled independently
+create table if not exists login_attempts (
+    key varchar(320) primary key,
+    failures integer not null default 0,
+    last_failure_at timestamp without time zone not null default now(),
+    locked_until timestamp without time zone
+);
+
+create index if not exists login_attempts_locked_until_idx on login_attempts (locked_until);
@@ -0,0 +1,3 @@
+drop table if exists mfa_tickets;
+drop table if exists recovery_codes;
+drop table if exists user_totp;
@@ -0,0 +1,28 @@
+-- a row exists once a user starts enrolling, enabled flips after they prove
+-- their authenticator works; last_step stops a code being used twice
+create table if not exists user_totp (
+    user_id integer primary key references users (id) on delete cascade,
+    secret varchar(64) not null,
+    enabled boolean not null default false,
+    last_step bigint not null default 0,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create table if not exists recovery_codes (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    code_hash bytea not null,
+    created_at timestamp without time zone not null default now(),
+    used_at timestamp without time zone,
+    unique (user_id, code_hash)
+);
+
+-- handed out by the first login step, exchanged with a code for real tokens
+create table if not exists mfa_tickets (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    ticket_hash bytea not null unique,
+    created_at timestamp without time zone not null default now(),
+    expiry timestamp without time zone not null
+);
@@ -0,0 +1,9 @@
+drop trigger if exists authors_search_vector_trigger on authors;
+drop function if exists authors_search_vector_update();
+
+drop trigger if exists books_search_vector_trigger on books;
+drop function if exists books_search_vector_update();
+
+drop index if exists books_search_vector_idx;
+
+alter table books drop column search_vector;
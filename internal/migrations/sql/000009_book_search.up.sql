@@ -0,0 +1,36 @@
+-- search_vector is kept up to date by triggers, titles weigh most, then the
+-- author's name, then the description
+alter table books add column if not exists search_vector tsvector not null default '';
+
+create or replace function books_search_vector_update() returns trigger as $$
+begin
+    new.search_vector :=
+        setweight(to_tsvector('english', coalesce(new.title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce((select author_name from authors where id = new.author_id), '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(new.description, '')), 'C');
+    return new;
+end
+$$ language plpgsql;
+
+drop trigger if exists books_search_vector_trigger on books;
+create trigger books_search_vector_trigger
+    before insert or update of title, description, author_id on books
+    for each row execute procedure books_search_vector_update();
+
+-- renaming an author changes the vector of every one of their books
+create or replace function authors_search_vector_update() returns trigger as $$
+begin
+    update books set title = title where author_id = new.id;
+    return null;
+end
+$$ language plpgsql;
+
+drop trigger if exists authors_search_vector_trigger on authors;
+create trigger authors_search_vector_trigger
+    after update of author_name on authors
+    for each row when (old.author_name is distinct from new.author_name)
+    execute procedure authors_search_vector_update();
+
+update books set title = title;
+
+create index if not exists books_search_vector_idx on books using gin (search_vector);
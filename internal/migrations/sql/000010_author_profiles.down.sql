@@ -0,0 +1,4 @@
+drop index if exists authors_slug_idx;
+
+alter table authors drop column bio;
+alter table authors drop column slug;
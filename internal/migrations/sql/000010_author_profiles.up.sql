@@ -0,0 +1,20 @@
+-- authors get public pages addressed by slug, with a bio. Photos live in
+-- static/authors/<slug>.jpg, the same way book covers do
+alter table authors add column if not exists slug varchar(512) not null default '';
+alter table authors add column if not exists bio text not null default '';
+
+-- existing authors sharing a name get their id appended to stay unique
+with slugs as (
+    select id,
+        trim(both '-' from regexp_replace(lower(author_name), '[^a-z0-9]+', '-', 'g')) as slug,
+        row_number() over (
+            partition by trim(both '-' from regexp_replace(lower(author_name), '[^a-z0-9]+', '-', 'g'))
+            order by id
+        ) as n
+    from authors
+)
+update authors a set slug = case when s.n = 1 then s.slug else s.slug || '-' || a.id end
+from slugs s
+where s.id = a.id;
+
+create unique index if not exists authors_slug_idx on authors (slug);
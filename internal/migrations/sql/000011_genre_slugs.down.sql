@@ -0,0 +1,3 @@
+drop index if exists genres_slug_idx;
+
+alter table genres drop column slug;
@@ -0,0 +1,18 @@
+-- genres get slugs for the public genre pages, names sharing a slug get
+-- their id appended
+alter table genres add column if not exists slug varchar(255) not null default '';
+
+with slugs as (
+    select id,
+        trim(both '-' from regexp_replace(lower(genre_name), '[^a-z0-9]+', '-', 'g')) as slug,
+        row_number() over (
+            partition by trim(both '-' from regexp_replace(lower(genre_name), '[^a-z0-9]+', '-', 'g'))
+            order by id
+        ) as n
+    from genres
+)
+update genres g set slug = case when s.n = 1 then s.slug else s.slug || '-' || g.id end
+from slugs s
+where s.id = g.id;
+
+create unique index if not exists genres_slug_idx on genres (slug);
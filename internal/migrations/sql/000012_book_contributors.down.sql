@@ -0,0 +1,23 @@
+drop trigger if exists book_contributors_search_vector_trigger on book_contributors;
+drop function if exists book_contributors_search_vector_update();
+
+create or replace function books_search_vector_update() returns trigger as $$
+begin
+    new.search_vector :=
+        setweight(to_tsvector('english', coalesce(new.title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce((select author_name from authors where id = new.author_id), '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(new.description, '')), 'C');
+    return new;
+end
+$$ language plpgsql;
+
+create or replace function authors_search_vector_update() returns trigger as $$
+begin
+    update books set title = title where author_id = new.id;
+    return null;
+end
+$$ language plpgsql;
+
+drop table if exists book_contributors;
+
+update books set title = title;
@@ -0,0 +1,61 @@
+-- books can have several contributors, each with a role and a position in
+-- the credits. books.author_id stays as the primary author, who is always
+-- credited first with the author role.
+create table if not exists book_contributors (
+    id serial primary key,
+    book_id integer not null references books (id) on delete cascade,
+    author_id integer not null references authors (id),
+    role varchar(32) not null default 'author'
+        check (role in ('author', 'co-author', 'editor', 'translator', 'illustrator')),
+    position integer not null default 0,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now(),
+    unique (book_id, author_id, role)
+);
+
+create index if not exists book_contributors_author_id_idx on book_contributors (author_id);
+
+insert into book_contributors (book_id, author_id, role, position)
+select id, author_id, 'author', 0 from books
+on conflict do nothing;
+
+-- every contributor's name is searchable with the author's weight
+create or replace function books_search_vector_update() returns trigger as $$
+begin
+    new.search_vector :=
+        setweight(to_tsvector('english', coalesce(new.title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce((
+            select string_agg(a.author_name, ' ')
+            from authors a
+            where a.id = new.author_id
+                or a.id in (select author_id from book_contributors where book_id = new.id)
+        ), '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(new.description, '')), 'C');
+    return new;
+end
+$$ language plpgsql;
+
+create or replace function authors_search_vector_update() returns trigger as $$
+begin
+    update books set title = title
+    where author_id = new.id
+        or id in (select book_id from book_contributors where author_id = new.id);
+    return null;
+end
+$$ language plpgsql;
+
+create or replace function book_contributors_search_vector_update() returns trigger as $$
+begin
+    if tg_op = 'DELETE' then
+        update books set title = title where id = old.book_id;
+    else
+        update books set title = title where id = new.book_id;
+    end if;
+    return null;
+end
+$$ language plpgsql;
+
+drop trigger if exists book_contributors_search_vector_trigger on book_contributors;
+create trigger book_contributors_search_vector_trigger
+    after insert or update or delete on book_contributors
+    for each row execute procedure book_contributors_search_vector_update();
@@ -0,0 +1,5 @@
+-- the cover's file name in static/covers, now that covers are not always
+-- jpegs. Existing books keep the <slug>.jpg name they were saved under.
+alter table books add column if not exists cover varchar(512) not null default '';
+
+update books set cover = slug || '.jpg' where cover = '';
@@ -0,0 +1,3 @@
+-- resized copies of the cover in every size and format, with their file names
+-- and dimensions, keyed by size name
+alter table books add column if not exists covers jsonb not null default '{}';
@@ -0,0 +1,9 @@
+-- slugs a book had before it was renamed, so old links can be redirected
+-- to where the book lives now
+create table if not exists book_slugs (
+    slug varchar(512) primary key,
+    book_id integer not null references books(id) on delete cascade,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists book_slugs_book_id_idx on book_slugs (book_id);
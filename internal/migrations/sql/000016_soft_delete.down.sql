@@ -0,0 +1,8 @@
+drop index if exists users_deleted_at_idx;
+drop index if exists books_deleted_at_idx;
+
+delete from users where deleted_at is not null;
+delete from books where deleted_at is not null;
+
+alter table users drop column deleted_at;
+alter table books drop column deleted_at;
@@ -0,0 +1,7 @@
+-- deleted books and users stay in the trash, hidden everywhere else, until
+-- they are restored or purged after the retention period
+alter table books add column if not exists deleted_at timestamp without time zone;
+alter table users add column if not exists deleted_at timestamp without time zone;
+
+create index if not exists books_deleted_at_idx on books (deleted_at) where deleted_at is not null;
+create index if not exists users_deleted_at_idx on users (deleted_at) where deleted_at is not null;
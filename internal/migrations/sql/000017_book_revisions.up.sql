@@ -0,0 +1,31 @@
+-- every change to a book is kept as a numbered revision holding a full
+-- snapshot of the book, its genres and contributors
+create table if not exists book_revisions (
+    id serial primary key,
+    book_id integer not null references books (id) on delete cascade,
+    revision integer not null,
+    editor_id integer references users (id) on delete set null,
+    action varchar(32) not null,
+    snapshot jsonb not null,
+    created_at timestamp without time zone not null default now(),
+    unique (book_id, revision)
+);
+
+-- existing books start from a baseline of how they are now
+insert into book_revisions (book_id, revision, action, snapshot, created_at)
+select b.id, 1, 'baseline', jsonb_build_object(
+        'title', b.title,
+        'author_id', b.author_id,
+        'publication_year', b.publication_year,
+        'slug', b.slug,
+        'description', b.description,
+        'cover', b.cover,
+        'covers', b.covers,
+        'genre_ids', coalesce((select jsonb_agg(bg.genre_id order by bg.genre_id)
+            from books_genres bg where bg.book_id = b.id), '[]'::jsonb),
+        'contributors', coalesce((select jsonb_agg(jsonb_build_object(
+                'author_id', bc.author_id, 'role', bc.role, 'position', bc.position) order by bc.position)
+            from book_contributors bc where bc.book_id = b.id), '[]'::jsonb)
+    ), b.updated_at
+from books b
+on conflict (book_id, revision) do nothing;
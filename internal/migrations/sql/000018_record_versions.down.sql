@@ -0,0 +1,2 @@
+alter table users drop column version;
+alter table books drop column version;
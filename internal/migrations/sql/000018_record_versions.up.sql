@@ -0,0 +1,4 @@
+-- every change to a book or user bumps its version, saves must name the
+-- version they were made from so two editors can't overwrite each other
+alter table books add column if not exists version integer not null default 1;
+alter table users add column if not exists version integer not null default 1;
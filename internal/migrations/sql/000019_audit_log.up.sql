@@ -0,0 +1,31 @@
+-- who did what to which record, from where. Rows outlive the users and
+-- records they name, so there are no foreign keys, and they can't be changed
+-- or deleted once written
+create table if not exists audit_log (
+    id bigserial primary key,
+    actor_id integer,
+    actor_email varchar(255) not null default '',
+    action varchar(64) not null,
+    target_type varchar(32) not null default '',
+    target_id varchar(255) not null default '',
+    before jsonb,
+    after jsonb,
+    status integer not null,
+    ip_address varchar(64) not null default '',
+    request_id varchar(128) not null default '',
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists audit_log_created_at_idx on audit_log (created_at);
+create index if not exists audit_log_actor_idx on audit_log (actor_id, created_at);
+create index if not exists audit_log_target_idx on audit_log (target_type, target_id, created_at);
+
+create or replace function audit_log_append_only() returns trigger as $$
+begin
+    raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+drop trigger if exists audit_log_append_only on audit_log;
+create trigger audit_log_append_only before update or delete on audit_log
+    for each row execute function audit_log_append_only();
@@ -0,0 +1,2 @@
+alter table authors drop column photos;
+alter table authors drop column photo;
@@ -0,0 +1,4 @@
+-- author photos are cleaned and resized like book covers, photo is the file
+-- name of the cleaned original and photos its resized copies, keyed by size
+alter table authors add column if not exists photo varchar(512) not null default '';
+alter table authors add column if not exists photos jsonb not null default '{}';
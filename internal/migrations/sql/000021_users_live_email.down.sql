@@ -0,0 +1,7 @@
+-- trashed users whose email was registered again cannot keep it, so they are
+-- purged early
+delete from users u where u.deleted_at is not null
+    and exists (select 1 from users o where o.email = u.email and o.id <> u.id);
+
+drop index if exists users_email_live_idx;
+alter table users add constraint users_email_key unique (email);
@@ -0,0 +1,5 @@
+-- only users outside the trash need a unique email, so the address of a
+-- deleted user can be registered again. Restoring that user then fails on
+-- the index until one of the two addresses is changed.
+alter table users drop constraint if exists users_email_key;
+create unique index if not exists users_email_live_idx on users (email) where deleted_at is null;
@@ -0,0 +1,11 @@
+-- a merged genre is deleted, its id is kept here pointing at the genre it
+-- was merged into so reverting a book to an older revision can follow it.
+-- Merging the surviving genre again moves the row along, deleting it drops
+-- the row.
+create table if not exists genre_merges (
+    from_id integer primary key,
+    into_id integer not null references genres (id) on delete cascade,
+    merged_at timestamp without time zone not null default now()
+);
+
+create index if not exists genre_merges_into_id_idx on genre_merges (into_id);
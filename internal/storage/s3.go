@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config configures an S3 compatible bucket, such as one on AWS or MinIO
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+
+	// PublicURL is where a public bucket's objects are served from, such as
+	// a CDN. It defaults to the bucket on Endpoint.
+	PublicURL string
+
+	// Private buckets are read through presigned urls that expire after
+	// URLExpiry
+	Private   bool
+	URLExpiry time.Duration
+}
+
+// S3 stores files in a bucket of an S3 compatible object store, so any
+// number of API instances can share them
+type S3 struct {
+	client    *minio.Client
+	bucket    string
+	publicURL string
+	private   bool
+	urlExpiry time.Duration
+}
+
+// NewS3 returns an S3 for the bucket in cfg, it does not contact the server
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("storage: an S3 endpoint and bucket are required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &S3{
+		client:    client,
+		bucket:    cfg.Bucket,
+		publicURL: strings.TrimSuffix(cfg.PublicURL, "/"),
+		private:   cfg.Private,
+		urlExpiry: cfg.URLExpiry,
+	}
+
+	if s.publicURL == "" {
+		s.publicURL = strings.TrimSuffix(client.EndpointURL().String(), "/") + "/" + cfg.Bucket
+	}
+
+	if s.urlExpiry <= 0 {
+		s.urlExpiry = time.Hour
+	}
+
+	return s, nil
+}
+
+// EnsureBucket creates the bucket if it does not exist yet
+func (s *S3) EnsureBucket(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	return s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{})
+}
+
+// Put uploads content under key
+func (s *S3) Put(ctx context.Context, key string, content []byte, contentType string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+
+	return err
+}
+
+// Get downloads the object stored under key
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	defer obj.Close()
+
+	content, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return content, nil
+}
+
+// Delete removes the object stored under key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// URL returns a presigned url for key when the bucket is private, and its
+// public url otherwise
+func (s *S3) URL(ctx context.Context, key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if s.private {
+		u, err := s.client.PresignedGetObject(ctx, s.bucket, key, s.urlExpiry, nil)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	return s.publicURL + "/" + (&url.URL{Path: key}).EscapedPath(), nil
+}
+
+// notFound turns the error S3 returns for a missing key into ErrNotFound
+func notFound(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
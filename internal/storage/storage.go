@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrNotFound is returned by Get when no object is stored under a key
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage keeps uploaded files, such as book covers, under slash separated
+// keys like "covers/it.jpg"
+type Storage interface {
+	// Put stores content under key, replacing anything already there
+	Put(ctx context.Context, key string, content []byte, contentType string) error
+	// Get returns the content stored under key, or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes key, it is not an error if nothing is stored there
+	Delete(ctx context.Context, key string) error
+	// URL returns where clients can download key from
+	URL(ctx context.Context, key string) (string, error)
+}
+
+// cleanKey turns key into a relative path that cannot climb out of the
+// storage root
+func cleanKey(key string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if cleaned == "" {
+		return "", errors.New("storage: empty key")
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorage puts, reads, replaces and deletes a file in s under prefix
+func testStorage(t *testing.T, s Storage, prefix string) {
+	t.Helper()
+
+	ctx := context.Background()
+	key := prefix + "/covers/12/3f2a9c1d.jpg"
+
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put: err = %v, want ErrNotFound", err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		if err := s.Put(ctx, key, []byte(content), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("Get = %q, want %q", got, content)
+		}
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete: err = %v, want ErrNotFound", err)
+	}
+
+	// deleting what is not there is not an error
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"covers/it.jpg", "covers/it.jpg"},
+		{"/covers/it.jpg", "covers/it.jpg"},
+		{"covers//12/./it.jpg", "covers/12/it.jpg"},
+		{"../covers/it.jpg", "covers/it.jpg"},
+		{"covers/../../../etc/passwd", "etc/passwd"},
+		{"/../../etc/passwd", "etc/passwd"},
+	}
+
+	for _, tt := range tests {
+		got, err := cleanKey(tt.key)
+		if err != nil {
+			t.Fatalf("cleanKey(%q): %v", tt.key, err)
+		}
+		if got != tt.want {
+			t.Fatalf("cleanKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	for _, key := range []string{"", "/", "..", "../.."} {
+		if _, err := cleanKey(key); err == nil {
+			t.Fatalf("cleanKey(%q) did not fail", key)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "static")
+	local := NewLocal(root, "/static/")
+
+	testStorage(t, local, "test")
+
+	ctx := context.Background()
+
+	// a key climbing out of the root stays inside it
+	if err := local.Put(ctx, "../../escaped.txt", []byte("caught"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file was written outside the root: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(root, "escaped.txt"))
+	if err != nil || string(content) != "caught" {
+		t.Fatalf("file inside the root = %q, %v", content, err)
+	}
+
+	if err := local.Put(ctx, "", []byte("x"), "text/plain"); err == nil {
+		t.Fatal("Put with an empty key did not fail")
+	}
+
+	// no staged files are left behind
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".staged-") {
+			t.Fatalf("staged file %s left behind", entry.Name())
+		}
+	}
+
+	url, err := local.URL(ctx, "covers/12/a cover.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/static/covers/12/a%20cover.jpg" {
+		t.Fatalf("URL = %q", url)
+	}
+
+	url, err = local.URL(ctx, "../covers/it.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/static/covers/it.jpg" {
+		t.Fatalf("URL of a climbing key = %q", url)
+	}
+}
+
+// TestS3 runs against the minio service in docker-compose.yml, or any S3
+// compatible server, when S3_TEST_ENDPOINT is set such as localhost:9000.
+// S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY default to the compose
+// credentials.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	accessKey := os.Getenv("S3_TEST_ACCESS_KEY")
+	if accessKey == "" {
+		accessKey = "minio"
+	}
+	secretKey := os.Getenv("S3_TEST_SECRET_KEY")
+	if secretKey == "" {
+		secretKey = "password"
+	}
+
+	ctx := context.Background()
+	prefix := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	for _, private := range []bool{false, true} {
+		s3, err := NewS3(S3Config{
+			Endpoint:  endpoint,
+			Bucket:    "go-api-test",
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Private:   private,
+			URLExpiry: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s3.EnsureBucket(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		testStorage(t, s3, prefix)
+
+		key := prefix + "/../covers/url.jpg"
+		if err := s3.Put(ctx, key, []byte("served"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+
+		url, err := s3.URL(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(url, "/go-api-test/covers/url.jpg") {
+			t.Fatalf("URL = %q", url)
+		}
+
+		// the test bucket is not public, so only presigned urls download
+		if private {
+			res, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || string(body) != "served" {
+				t.Fatalf("GET presigned url = %d %q", res.StatusCode, body)
+			}
+		}
+
+		if err := s3.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
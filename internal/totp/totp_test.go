@@ -0,0 +1,124 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode checks the SHA-1 vectors of RFC 6238 appendix B. The RFC lists
+// 8 digit codes, the 6 digit ones are their last 6 digits.
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// secrets are accepted in lower case and with padding
+	if got, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq====", 1); err != nil || got != "287082" {
+		t.Fatalf("lower case padded secret: %s, %v", got, err)
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Fatal("invalid secret accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		ok       bool
+	}{
+		{"current step", code(current), current, true},
+		{"one step behind", code(current - 1), current - 1, true},
+		{"one step ahead", code(current + 1), current + 1, true},
+		{"two steps behind", code(current - 2), 0, false},
+		{"two steps ahead", code(current + 2), 0, false},
+		{"spaced out", code(current)[:3] + " " + code(current)[3:], current, true},
+		{"surrounding space", " " + code(current) + "\n", current, true},
+		{"too short", code(current)[:5], 0, false},
+		{"too long", code(current) + "0", 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.ok || step != tt.wantStep {
+				t.Fatalf("Validate = %d, %v, want %d, %v", step, ok, tt.wantStep, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Fatal("two secrets are the same")
+	}
+
+	key, err := encoding.DecodeString(a)
+	if err != nil || len(key) != secretSz {
+		t.Fatalf("secret %s decodes to %d bytes, %v", a, len(key), err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI(rfcSecret, "Go API", "admin@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Go API:admin@example.com" {
+		t.Fatalf("uri %s has the wrong label", uri)
+	}
+
+	want := map[string]string{"secret": rfcSecret, "issuer": "Go API", "algorithm": "SHA1", "digits": "6", "period": "30"}
+	for k, v := range want {
+		if got := uri.Query().Get(k); got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+}